@@ -2,3 +2,5 @@ GOPATH=`pwd`
 go get github.com/bitly/go-simplejson
 go get github.com/streadway/amqp
 
+# only needed for zstd compressed stat stores, built with -tags zstd
+go get github.com/klauspost/compress/zstd
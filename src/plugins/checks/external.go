@@ -1,13 +1,13 @@
 package checks
 
 import (
-	"fmt"
 	"os/exec"
 	"plugins"
+	"strings"
 )
 
 type ExternalCheck struct {
-	command     string
+	args        []string
 	name        string
 	checkStatus plugins.Status
 }
@@ -15,26 +15,40 @@ type ExternalCheck struct {
 func (ec *ExternalCheck) Init(config plugins.PluginConfig) (string, error) {
 	// make sure that the command exists?
 	ec.name = config.Name
-	ec.command = config.Command
+	ec.args = config.Args
+	if 0 == len(ec.args) {
+		ec.args = strings.Fields(config.Command)
+	}
 	return ec.name, nil
 }
 
+// the exit status of the command is the status of the check, as with any
+// sensu plugin: 0 OK, 1 WARNING, 2 CRITICAL and anything else UNKNOWN
 func (ec *ExternalCheck) Gather(r *plugins.Result) error {
-	fmt.Printf("About to start command\n")
-	cmd := exec.Command(ec.command)
-	err := cmd.Run()
 	ec.checkStatus = plugins.UNKNOWN
+	if 0 == len(ec.args) {
+		r.Add("No command to run")
+		return nil
+	}
 
-	out, errOut := cmd.CombinedOutput()
-	fmt.Println("Output BELOW")
-	fmt.Println(out)
-	r.Add(string(out))
-	if nil == errOut {
+	out, err := exec.Command(ec.args[0], ec.args[1:]...).CombinedOutput()
+	r.Add(strings.TrimRight(string(out), "\n"))
+
+	if nil == err {
 		ec.checkStatus = plugins.OK
-	} else {
-		ec.checkStatus = plugins.WARNING
+		return nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		switch exitErr.ExitCode() {
+		case 1:
+			ec.checkStatus = plugins.WARNING
+		case 2:
+			ec.checkStatus = plugins.CRITICAL
+		}
+		return nil
 	}
 
+	// the command could not be run at all
 	return err
 }
 
@@ -0,0 +1,35 @@
+package checks
+
+import (
+	"plugins"
+	"testing"
+)
+
+func Test_ExternalCheckExitStatus(t *testing.T) {
+	var tests = []struct {
+		command string
+		status  plugins.Status
+	}{
+		{"exit 0", plugins.OK},
+		{"exit 1", plugins.WARNING},
+		{"exit 2", plugins.CRITICAL},
+		{"exit 3", plugins.UNKNOWN},
+	}
+
+	for _, test := range tests {
+		ec := new(ExternalCheck)
+		ec.Init(plugins.PluginConfig{Name: "external", Args: []string{"sh", "-c", test.command}})
+		if err := ec.Gather(new(plugins.Result)); nil != err {
+			t.Errorf("%s: %v", test.command, err)
+		}
+		if "external "+test.status.ToString() != ec.GetStatus() {
+			t.Errorf("%s: expected %s, got %s", test.command, test.status.ToString(), ec.GetStatus())
+		}
+	}
+
+	ec := new(ExternalCheck)
+	ec.Init(plugins.PluginConfig{Name: "external", Command: "/does/not/exist"})
+	if err := ec.Gather(new(plugins.Result)); nil == err {
+		t.Error("expected an error for a command that cannot be run")
+	}
+}
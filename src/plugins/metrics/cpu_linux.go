@@ -66,13 +66,14 @@ func (cpu *CpuStats) createPayload(r *plugins.Result) error {
 		// grab our frequency stats
 		for i := 0; i < cpu.cpu_count; i++ {
 			speed = cpu.getCpuValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/cpuinfo_cur_freq", i))
-			r.Add(fmt.Sprintf("cpu.cpu%d.frequency.current %d", i, speed))
+			core := map[string]string{"cpu": fmt.Sprintf("cpu%d", i)}
+			r.AddMetric(fmt.Sprintf("cpu.cpu%d.frequency.current", i), float64(speed), core)
 
 			speed = cpu.getCpuValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/cpuinfo_max_freq", i))
-			r.Add(fmt.Sprintf("cpu.cpu%d.frequency.max %d", i, speed))
+			r.AddMetric(fmt.Sprintf("cpu.cpu%d.frequency.max", i), float64(speed), core)
 
 			speed = cpu.getCpuValue(fmt.Sprintf("/sys/devices/system/cpu/cpu%d/cpufreq/cpuinfo_min_freq", i))
-			r.Add(fmt.Sprintf("cpu.cpu%d.frequency.min %d", i, speed))
+			r.AddMetric(fmt.Sprintf("cpu.cpu%d.frequency.min", i), float64(speed), core)
 		}
 
 		if cpu.failed_freq_gather_count >= cpu.cpu_count {
@@ -80,7 +81,7 @@ func (cpu *CpuStats) createPayload(r *plugins.Result) error {
 			log.Printf("Failed gathering CPU Frequency Stats. Disabling future freq gathering.")
 		}
 	}
-	r.Add(fmt.Sprintf("cpu.cpu_count %d", cpu.cpu_count))
+	r.AddMetric("cpu.cpu_count", float64(cpu.cpu_count), nil)
 
 	// now time to get the CPU stats
 	file, err := ioutil.ReadFile("/proc/stat")
@@ -104,13 +105,25 @@ func (cpu *CpuStats) createPayload(r *plugins.Result) error {
 				name = "total"
 			}
 
+			core := map[string]string{"cpu": name}
 			for i, field := range cpu_metrics {
-				r.Add(fmt.Sprintf("cpu.%s.%s %s", name, field, fields[i+1]))
+				if i+1 >= len(fields) {
+					break
+				}
+				if value, err := strconv.ParseFloat(fields[i+1], 64); nil == err {
+					r.AddCounter(fmt.Sprintf("cpu.%s.%s", name, field), value, core)
+				}
 			}
 		}
 		switch fields[0] {
-		case "ctxt", "processes", "procs_running", "procs_blocked", "btime", "intr":
-			r.Add(fmt.Sprintf("cpu.%s %s", fields[0], fields[1]))
+		case "ctxt", "processes", "intr":
+			if value, err := strconv.ParseFloat(fields[1], 64); nil == err {
+				r.AddCounter(fmt.Sprintf("cpu.%s", fields[0]), value, nil)
+			}
+		case "procs_running", "procs_blocked", "btime":
+			if value, err := strconv.ParseFloat(fields[1], 64); nil == err {
+				r.AddMetric(fmt.Sprintf("cpu.%s", fields[0]), value, nil)
+			}
 		}
 	}
 
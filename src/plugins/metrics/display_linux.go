@@ -1,10 +1,10 @@
 package metrics
 
 import (
-	"fmt"
 	"io/ioutil"
 	"log"
 	"plugins"
+	"strconv"
 	"strings"
 )
 
@@ -22,9 +22,13 @@ func (display *DisplayStats) createPayload(r *plugins.Result) error {
 		return nil
 	}
 
-	value := strings.Trim(string(content), "\n ")
+	value, err := strconv.ParseFloat(strings.Trim(string(content), "\n "), 64)
+	if nil != err {
+		log.Printf("Unexpected HDMI State. %s", err)
+		return nil
+	}
 
-	r.Add(fmt.Sprintf("display.hdmi %s", value))
+	r.AddMetric("display.hdmi", value, nil)
 
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"plugins"
+	"strconv"
 	"strings"
 )
 
@@ -17,10 +18,17 @@ func (load *LoadStats) createPayload(r *plugins.Result) error {
 	}
 
 	bits := strings.Split(string(content), " ")
+	if len(bits) < 3 {
+		return fmt.Errorf("Unexpected /proc/loadavg: %q", content)
+	}
 
-	r.Add(fmt.Sprintf("load_avg.one %s", bits[0]))
-	r.Add(fmt.Sprintf("load_avg.five %s", bits[1]))
-	r.Add(fmt.Sprintf("load_avg.fifteen %s", bits[2]))
+	for i, name := range []string{"one", "five", "fifteen"} {
+		value, err := strconv.ParseFloat(bits[i], 64)
+		if nil != err {
+			return err
+		}
+		r.AddMetric("load_avg."+name, value, nil)
+	}
 
 	return nil
 }
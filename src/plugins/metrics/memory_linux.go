@@ -1,7 +1,6 @@
 package metrics
 
 import (
-	"fmt"
 	"io/ioutil"
 	"plugins"
 	"regexp"
@@ -53,7 +52,7 @@ func (mem *MemoryStats) createPayload(r *plugins.Result) error {
 
 	for label, value := range memoryValues {
 		// memory is reported in KB, we need Bytes - bitshift 10 is the same as *1024
-		r.Add(fmt.Sprintf("memory.%s %d", label, value<<10)) // value<<10 == value*1024
+		r.AddMetric("memory."+label, float64(value<<10), nil) // value<<10 == value*1024
 	}
 
 	return nil
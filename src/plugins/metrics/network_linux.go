@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"plugins"
+	"strconv"
 	"strings"
 )
 
@@ -35,7 +36,12 @@ func (iface *NetworkInterfaceStats) createPayload(r *plugins.Result) error {
 				return err
 			}
 
-			r.Add(fmt.Sprintf("interface.%s.%s %s", interface_info.Name(), file_info.Name(), strings.Trim(string(value), " \n\t")))
+			number, err := strconv.ParseFloat(strings.Trim(string(value), " \n\t"), 64)
+			if nil != err {
+				return nil // not every statistic can be read on every interface
+			}
+
+			r.AddCounter(fmt.Sprintf("interface.%s.%s", interface_info.Name(), file_info.Name()), number, map[string]string{"interface": interface_info.Name()})
 			return nil
 		})
 
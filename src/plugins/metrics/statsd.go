@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"plugins"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsD listener
+//
+// DESCRIPTION
+//  This plugin listens for StatsD counters, gauges, timers and sets over UDP
+//  and reports what it has aggregated each time the check runs, so the check
+//  interval is the flush interval.
+//
+// OUTPUT
+//   Graphite plain-text format (name value timestamp\n)
+//
+// PLATFORMS
+//   All
+
+const STATSD_NAME = "statsd_metrics"
+
+const statsdPacketSize = 65535
+
+type StatsdStats struct {
+	lock       sync.Mutex // guards everything below, Init can run while we are listening
+	flags      *flag.FlagSet
+	address    string
+	percentile float64
+	conn       net.PacketConn
+	listening  string // the address we are listening on, a restart on the same address keeps it
+	counters   map[string]float64
+	gauges     map[string]float64 // kept between flushes, as statsd does
+	timers     map[string][]float64
+	timerCount map[string]float64 // the number of timings, allowing for sample rates
+	sets       map[string]map[string]bool
+	badLines   float64
+	lastFlush  time.Time
+}
+
+func init() {
+	plugins.Register(STATSD_NAME, new(StatsdStats))
+}
+
+func (statsd *StatsdStats) Init(config plugins.PluginConfig) (string, error) {
+	statsd.lock.Lock()
+	defer statsd.lock.Unlock()
+
+	statsd.flags = flag.NewFlagSet("statsd-metrics", flag.ContinueOnError)
+	statsd.flags.StringVar(&statsd.address, "listen", ":8125", "The UDP address to listen for StatsD on")
+	statsd.flags.Float64Var(&statsd.percentile, "percentile", 90, "The percentile reported for timers")
+
+	if len(config.Args) > 1 {
+		if err := statsd.flags.Parse(config.Args[1:]); nil != err {
+			return STATSD_NAME, err
+		}
+	}
+
+	if nil == statsd.counters {
+		statsd.reset()
+		statsd.gauges = make(map[string]float64)
+		statsd.lastFlush = time.Now()
+	}
+
+	// we are set up again each time RabbitMQ comes back, keep listening where we are
+	if nil != statsd.conn {
+		if statsd.listening == statsd.address {
+			return STATSD_NAME, nil
+		}
+		statsd.conn.Close()
+	}
+
+	conn, err := net.ListenPacket("udp", statsd.address)
+	if nil != err {
+		statsd.conn = nil
+		return STATSD_NAME, fmt.Errorf("Unable to listen for StatsD: %s", err)
+	}
+	statsd.conn = conn
+	statsd.listening = statsd.address
+	log.Printf("Listening for StatsD on %s", conn.LocalAddr())
+	go statsd.listen(conn)
+
+	return STATSD_NAME, nil
+}
+
+// stops listening, which Init starts again. what has been aggregated is kept
+// for the next Gather
+func (statsd *StatsdStats) Close() error {
+	statsd.lock.Lock()
+	defer statsd.lock.Unlock()
+
+	if nil == statsd.conn {
+		return nil
+	}
+	log.Printf("No longer listening for StatsD on %s", statsd.conn.LocalAddr())
+	err := statsd.conn.Close()
+	statsd.conn = nil
+	statsd.listening = ""
+	return err
+}
+
+// forgets everything but the gauges. the caller holds the lock
+func (statsd *StatsdStats) reset() {
+	statsd.counters = make(map[string]float64)
+	statsd.timers = make(map[string][]float64)
+	statsd.timerCount = make(map[string]float64)
+	statsd.sets = make(map[string]map[string]bool)
+	statsd.badLines = 0
+}
+
+func (statsd *StatsdStats) listen(conn net.PacketConn) {
+	buf := make([]byte, statsdPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if nil != err {
+			return // closed
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if "" != strings.TrimSpace(line) {
+				statsd.handle(line)
+			}
+		}
+	}
+}
+
+// takes a single "name:value|type|@rate" line. a line may carry several
+// values for the same name, "name:1|c:2|c"
+func (statsd *StatsdStats) handle(line string) {
+	statsd.lock.Lock()
+	defer statsd.lock.Unlock()
+
+	bits := strings.Split(strings.TrimSpace(line), ":")
+	name := statsdName(bits[0])
+	if "" == name || len(bits) < 2 {
+		statsd.badLines++
+		return
+	}
+
+	for _, sample := range bits[1:] {
+		if err := statsd.add(name, sample); nil != err {
+			statsd.badLines++
+		}
+	}
+}
+
+// the caller holds the lock
+func (statsd *StatsdStats) add(name, sample string) error {
+	fields := strings.Split(sample, "|")
+	if len(fields) < 2 {
+		return fmt.Errorf("No type: %q", sample)
+	}
+
+	rate := 1.0
+	if len(fields) > 2 && strings.HasPrefix(fields[2], "@") {
+		var err error
+		rate, err = strconv.ParseFloat(fields[2][1:], 64)
+		if nil != err || rate <= 0 || rate > 1 {
+			return fmt.Errorf("Invalid sample rate: %q", sample)
+		}
+	}
+
+	// sets take anything, the rest only numbers
+	if "s" == fields[1] {
+		if nil == statsd.sets[name] {
+			statsd.sets[name] = make(map[string]bool)
+		}
+		statsd.sets[name][fields[0]] = true
+		return nil
+	}
+
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if nil != err {
+		return err
+	}
+
+	switch fields[1] {
+	case "c":
+		statsd.counters[name] += value / rate
+	case "g":
+		// a signed gauge moves the last value rather than replacing it
+		if strings.HasPrefix(fields[0], "+") || strings.HasPrefix(fields[0], "-") {
+			statsd.gauges[name] += value
+		} else {
+			statsd.gauges[name] = value
+		}
+	case "ms", "h":
+		statsd.timers[name] = append(statsd.timers[name], value)
+		statsd.timerCount[name] += 1 / rate
+	default:
+		return fmt.Errorf("Unknown type: %q", sample)
+	}
+	return nil
+}
+
+var statsdInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// names in the style statsd keeps them: no spaces, slashes or anything odd
+func statsdName(name string) string {
+	name = strings.Replace(strings.TrimSpace(name), " ", "_", -1)
+	name = strings.Replace(name, "/", "-", -1)
+	return statsdInvalid.ReplaceAllString(name, "")
+}
+
+// reports everything aggregated since the last run
+func (statsd *StatsdStats) Gather(r *plugins.Result) error {
+	statsd.lock.Lock()
+	defer statsd.lock.Unlock()
+
+	if nil == statsd.conn {
+		return fmt.Errorf("Not listening for StatsD")
+	}
+
+	now := time.Now()
+	seconds := now.Sub(statsd.lastFlush).Seconds()
+	statsd.lastFlush = now
+
+	for _, name := range sortedKeys(statsd.counters) {
+		value := statsd.counters[name]
+		r.AddMetric("statsd.counters."+name+".count", value, nil)
+		if seconds > 0 {
+			r.AddMetric("statsd.counters."+name+".rate", value/seconds, nil)
+		}
+	}
+
+	for _, name := range sortedKeys(statsd.gauges) {
+		r.AddMetric("statsd.gauges."+name, statsd.gauges[name], nil)
+	}
+
+	for _, name := range sortedKeys(statsd.timerCount) {
+		stats := timerStats(statsd.timers[name], statsd.percentile)
+		for _, stat := range sortedKeys(stats) {
+			r.AddMetric("statsd.timers."+name+"."+stat, stats[stat], nil)
+		}
+		r.AddMetric("statsd.timers."+name+".count", statsd.timerCount[name], nil)
+	}
+
+	sets := make(map[string]float64)
+	for name, members := range statsd.sets {
+		sets[name] = float64(len(members))
+	}
+	for _, name := range sortedKeys(sets) {
+		r.AddMetric("statsd.sets."+name+".count", sets[name], nil)
+	}
+
+	r.AddMetric("statsd.bad_lines_seen", statsd.badLines, nil)
+
+	statsd.reset()
+	return nil
+}
+
+// the summary statsd gives for a flush worth of timings
+func timerStats(values []float64, percentile float64) map[string]float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	count := len(sorted)
+	sum := 0.0
+	for _, value := range sorted {
+		sum += value
+	}
+
+	stats := map[string]float64{
+		"lower": sorted[0],
+		"upper": sorted[count-1],
+		"sum":   sum,
+		"mean":  sum / float64(count),
+	}
+
+	middle := count / 2
+	if 0 == count%2 {
+		stats["median"] = (sorted[middle-1] + sorted[middle]) / 2
+	} else {
+		stats["median"] = sorted[middle]
+	}
+
+	// the highest value once the slowest (100 - percentile)% are left out
+	within := int(math.Ceil(percentile / 100 * float64(count)))
+	if within < 1 {
+		within = 1
+	} else if within > count {
+		within = count
+	}
+	name := strings.Replace(plugins.FormatValue(percentile), ".", "_", -1)
+	stats["upper_"+name] = sorted[within-1]
+	return stats
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (statsd *StatsdStats) GetStatus() string {
+	return ""
+}
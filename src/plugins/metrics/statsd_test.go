@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"net"
+	"plugins"
+	"testing"
+	"time"
+)
+
+func gatherStatsd(t *testing.T, statsd *StatsdStats) map[string]float64 {
+	r := new(plugins.Result)
+	if err := statsd.Gather(r); nil != err {
+		t.Fatalf("Gather failed: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, row := range r.Output() {
+		values[row.Name] = row.Value
+	}
+	return values
+}
+
+func Test_StatsdAggregates(t *testing.T) {
+	statsd := new(StatsdStats)
+	if _, err := statsd.Init(plugins.PluginConfig{Args: []string{"statsd_metrics", "--listen", "127.0.0.1:0", "--percentile", "90"}}); nil != err {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer statsd.conn.Close()
+
+	conn, err := net.Dial("udp", statsd.conn.LocalAddr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	packets := []string{
+		"hits:1|c\nhits:2|c|@0.5",
+		"queue:10|g\nqueue:-3|g",
+		"request time:1|ms:2|ms:3|ms:4|ms",
+		"users:alice|s\nusers:bob|s\nusers:alice|s",
+		"broken\nhits:x|c\nhits:1|q",
+	}
+	for _, packet := range packets {
+		conn.Write([]byte(packet))
+	}
+
+	// wait for the listener to see all of it
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		statsd.lock.Lock()
+		seen := statsd.badLines
+		statsd.lock.Unlock()
+		if 3 == seen || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	values := gatherStatsd(t, statsd)
+	expected := map[string]float64{
+		"statsd.counters.hits.count":          5,
+		"statsd.gauges.queue":                 7,
+		"statsd.timers.request_time.count":    4,
+		"statsd.timers.request_time.lower":    1,
+		"statsd.timers.request_time.upper":    4,
+		"statsd.timers.request_time.sum":      10,
+		"statsd.timers.request_time.mean":     2.5,
+		"statsd.timers.request_time.median":   2.5,
+		"statsd.timers.request_time.upper_90": 4,
+		"statsd.sets.users.count":             2,
+		"statsd.bad_lines_seen":               3,
+	}
+	for name, value := range expected {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("Expected %s to be %v, got %v (reported: %v)", name, value, got, ok)
+		}
+	}
+	if _, ok := values["statsd.counters.hits.rate"]; !ok {
+		t.Error("Expected a rate for the hits counter")
+	}
+
+	// only the gauges carry over to the next flush
+	values = gatherStatsd(t, statsd)
+	if 7 != values["statsd.gauges.queue"] {
+		t.Errorf("Expected the gauge to be kept, got %v", values["statsd.gauges.queue"])
+	}
+	if _, ok := values["statsd.counters.hits.count"]; ok {
+		t.Error("Expected the counters to be reset after a flush")
+	}
+	if 0 != values["statsd.bad_lines_seen"] {
+		t.Errorf("Expected the bad lines to be reset, got %v", values["statsd.bad_lines_seen"])
+	}
+
+	// set up again, as after a reconnect, we keep the same socket
+	listening := statsd.conn
+	statsd.Init(plugins.PluginConfig{Args: []string{"statsd_metrics", "--listen", "127.0.0.1:0"}})
+	if listening != statsd.conn {
+		t.Error("Expected the listener to be kept when set up again")
+	}
+}
+
+func Test_TimerStats(t *testing.T) {
+	stats := timerStats([]float64{5, 1, 3}, 99.5)
+	if 3 != stats["median"] || 5 != stats["upper_99_5"] || 1 != stats["lower"] {
+		t.Errorf("Unexpected timer stats %v", stats)
+	}
+}
+
+// Init runs again each time RabbitMQ comes back, while checks may be gathering
+func Test_StatsdInitWhileGathering(t *testing.T) {
+	statsd := new(StatsdStats)
+	config := plugins.PluginConfig{Args: []string{"statsd_metrics", "--listen", "127.0.0.1:0"}}
+	if _, err := statsd.Init(config); nil != err {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			statsd.Init(config)
+		}
+		close(done)
+	}()
+	for i := 0; i < 50; i++ {
+		statsd.Gather(new(plugins.Result))
+	}
+	<-done
+
+	statsd.lock.Lock()
+	statsd.conn.Close()
+	statsd.lock.Unlock()
+}
+
+// stopped and started again, as on a reload, we listen on the same address
+func Test_StatsdCloseListensAgain(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	statsd := new(StatsdStats)
+	config := plugins.PluginConfig{Args: []string{"statsd_metrics", "--listen", address}}
+	if _, err := statsd.Init(config); nil != err {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := statsd.Close(); nil != err {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if conn, err = net.ListenPacket("udp", address); nil != err {
+		t.Fatalf("expected %s to be free once closed: %v", address, err)
+	}
+	conn.Close()
+
+	if _, err := statsd.Init(config); nil != err {
+		t.Fatalf("expected Init to listen again: %v", err)
+	}
+	defer statsd.Close()
+	if nil == statsd.conn || address != statsd.conn.LocalAddr().String() {
+		t.Errorf("expected to be listening on %s again", address)
+	}
+}
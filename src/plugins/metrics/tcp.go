@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"plugins"
 	"regexp"
@@ -127,7 +128,7 @@ func (tcp *TcpStats) Gather(r *plugins.Result) error {
 	iface, err := interfaceAddress(tcp.listenInterface)
 	if err != nil {
 		log.Print(err)
-		// we do not return the error, because that will cause the check to be stopped.
+		// we do not return the error, because that will report the check as UNKNOWN and back it off.
 		// we return nil and no stats instead while we wait for the interface to get an
 		// ip address again. (e.g. happens when network manager disables interface)
 		return nil
@@ -150,8 +151,10 @@ func (tcp *TcpStats) Gather(r *plugins.Result) error {
 			latency, errPing := tcp.ping(tcp.localAddress, remoteIp, uint16(tcp.networkPort))
 			if errPing == nil {
 				totalLatency += latency
-				r.Add(fmt.Sprintf("tcp.latency.%s.ms %0.2f", tcp.hostNiceName, float32(totalLatency)/float32(time.Millisecond)))
-				r.Add(fmt.Sprintf("tcp.try-count.%s %d", tcp.hostNiceName, counter))
+				target := map[string]string{"target": tcp.hostNiceName}
+				latency := math.Round(100*float64(totalLatency)/float64(time.Millisecond)) / 100
+				r.AddMetric(fmt.Sprintf("tcp.latency.%s.ms", tcp.hostNiceName), latency, target)
+				r.AddMetric(fmt.Sprintf("tcp.try-count.%s", tcp.hostNiceName), float64(counter), target)
 				break
 			}
 			switch errPing.(type) {
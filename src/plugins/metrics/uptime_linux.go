@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"plugins"
+	"strconv"
 	"strings"
 )
 
@@ -14,8 +15,17 @@ func (u *UptimeStats) createPayload(r *plugins.Result) error {
 	}
 
 	uptime_idle := strings.Split(strings.Trim(string(content), " \n"), " ")
-	r.Add(fmt.Sprintf("uptime %s", uptime_idle[0]))
-	r.Add(fmt.Sprintf("uptime_idle %s", uptime_idle[1]))
+	if len(uptime_idle) < 2 {
+		return fmt.Errorf("Unexpected /proc/uptime: %q", content)
+	}
+
+	for i, name := range []string{"uptime", "uptime_idle"} {
+		value, err := strconv.ParseFloat(uptime_idle[i], 64)
+		if nil != err {
+			return err
+		}
+		r.AddMetric(name, value, nil)
+	}
 
 	return nil
 }
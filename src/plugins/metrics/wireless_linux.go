@@ -86,7 +86,7 @@ func (ws *WirelessStats) createPayload(r *plugins.Result) error {
 		}
 	}
 
-	r.Add(fmt.Sprintf("access_point.connected_clients %d", counter))
+	r.AddMetric("access_point.connected_clients", float64(counter), nil)
 
 	return nil
 }
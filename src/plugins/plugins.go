@@ -3,6 +3,8 @@ package plugins
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +18,9 @@ const (
 	UNKNOWN  Status = iota
 )
 
+// a plugin that holds on to something between runs, a listening socket say,
+// also implements io.Closer. it is closed when its checks are stopped and set
+// up again by the next Init
 type SensuPluginInterface interface {
 	Init(PluginConfig) (name string, err error)
 	Gather(*Result) error
@@ -31,6 +36,53 @@ type PluginConfig struct {
 	Handlers   []string      `json:"handlers"`
 	Standalone bool          `json:"standalone"`
 	Interval   time.Duration `json:"interval"`
+	Issued     int64         `json:"issued"` // when a subscription request was sent
+
+	Cron     string `json:"cron"`     // run at wall clock times instead of every interval
+	Timezone string `json:"timezone"` // the time zone for the cron expression
+
+	Splay         bool `json:"splay"`          // whether or not to offset the first run
+	SplayCoverage int  `json:"splay_coverage"` // percentage of the interval the offset may fall in
+
+	Subdue *Subdue `json:"subdue"` // when not to run the check
+
+	BackoffMax time.Duration `json:"backoff_max"` // the most seconds to wait between retries of a failing check
+	Overlap    string        `json:"overlap"`     // "skip" or "delay" a run that is due while the last one is still going
+
+	Dependencies     []string `json:"dependencies"`      // local checks that must be OK for this one to run
+	DependencyAction string   `json:"dependency_action"` // "skip" or "report" the check while a dependency is failing
+
+	LowFlapThreshold  int `json:"low_flap_threshold"`  // the state change percentage a flapping check has to drop to
+	HighFlapThreshold int `json:"high_flap_threshold"` // the state change percentage at which a check is flapping
+	Occurrences       int `json:"occurrences"`         // how many times in a row a check has to fail before we say so
+
+	Publish   string  `json:"publish"`   // send results "always", on a status "change" or when a metric moves by more than the "delta"
+	Heartbeat int     `json:"heartbeat"` // with change and delta, send a result at least every this many runs
+	Delta     float64 `json:"delta"`     // how far a metric has to move before it is sent
+
+	Hooks map[string]Hook `json:"hooks"` // commands to run when the check changes status, keyed by status
+
+	OutputFormat   string `json:"output_format"`   // how metrics are written: "graphite", "influx", "opentsdb" or "json"
+	OutputTemplate string `json:"output_template"` // maps graphite names to a measurement, field and tags
+	MetricPrefix   string `json:"metric_prefix"`   // template for the start of the metric names, instead of the client's
+	Route          string `json:"route"`           // send metrics to "rabbitmq", "carbon" or "both"
+	MaxOutputSize  int    `json:"max_output_size"` // bytes of output kept, instead of the client's limit
+
+	Custom map[string]interface{} `json:"-"` // any other attributes, passed on to the server with each result
+}
+
+// a diagnostic command run on the client when a check changes status
+type Hook struct {
+	Command string `json:"command"` // run through the shell, so pipes are fine
+	Timeout int    `json:"timeout"` // seconds before the command is killed
+}
+
+// a window of time during which a check is not run
+type Subdue struct {
+	Days       []string `json:"days"`       // days of the week the window applies to, every day when empty
+	Begin      string   `json:"begin"`      // time of day the window opens, e.g. "22:00" or "10:00 PM"
+	End        string   `json:"end"`        // time of day the window closes, may be before begin to span midnight
+	Exceptions []Subdue `json:"exceptions"` // windows within which the check runs anyway
 }
 
 type Status int // check status - not used for metrics
@@ -46,6 +98,30 @@ type ResultStat struct {
 	Output    string
 	Time      time.Time
 	TimeIsSet bool
+
+	// a metric added with AddMetric, written out by the check's output format
+	Name    string
+	Value   float64
+	Tags    map[string]string
+	Counter bool // only ever goes up, added with AddCounter
+}
+
+// whether this is a typed metric rather than a line of output
+func (s ResultStat) IsMetric() bool {
+	return "" != s.Name
+}
+
+// the output, or "name value" for a metric
+func (s ResultStat) String() string {
+	if s.IsMetric() {
+		return s.Name + " " + FormatValue(s.Value)
+	}
+	return s.Output
+}
+
+// metric values as plainly as they can be written: 12, 0.5, 1048576
+func FormatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
 }
 
 var statusLookupTable = map[Status]string{
@@ -77,6 +153,26 @@ func (r *Result) Add(output string) {
 	}
 }
 
+// adds a metric value, with optional tags. the name is relative to the metric
+// prefix, e.g. "load_avg.one"
+func (r *Result) AddMetric(name string, value float64, tags map[string]string) {
+	r.addMetric(ResultStat{Name: name, Value: value, Tags: tags, Time: time.Now()})
+}
+
+// adds a metric that only ever goes up, such as bytes sent, so that formats
+// which care can tell it from a gauge
+func (r *Result) AddCounter(name string, value float64, tags map[string]string) {
+	r.addMetric(ResultStat{Name: name, Value: value, Tags: tags, Counter: true, Time: time.Now()})
+}
+
+func (r *Result) addMetric(stat ResultStat) {
+	r.output = append(r.output, stat)
+
+	if "" != os.Getenv("DEBUG") {
+		log.Println("Metric: ", stat.String(), stat.Tags) // handy json debug printing
+	}
+}
+
 // grabs all of the results
 func (r *Result) Output() []ResultStat {
 	return r.output
@@ -86,7 +182,7 @@ func (r *Result) Output() []ResultStat {
 func (r *Result) OutputAsStrings() []string {
 	var o []string
 	for _, stat := range r.output {
-		o = append(o, stat.Output)
+		o = append(o, stat.String())
 	}
 	return o
 }
@@ -113,6 +209,22 @@ func (s Status) ToString() string {
 	return statusLookupTable[s]
 }
 
+// works out the status from a GetStatus() description such as "CheckProcs CRITICAL".
+// false when there is no status in it, as with metrics
+func ParseStatus(description string) (Status, bool) {
+	words := strings.Fields(description)
+	if 0 == len(words) {
+		return OK, false
+	}
+	last := strings.ToUpper(words[len(words)-1])
+	for status, name := range statusLookupTable {
+		if name == last {
+			return status, true
+		}
+	}
+	return OK, false
+}
+
 func (s Status) ToInt() int {
 	return int(s)
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"sensu"
 	"strings"
 	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 var (
@@ -18,6 +21,7 @@ var (
 	overrideHostName      string
 	overrideAddress       string
 	quiet                 bool
+	controlSocket         string
 )
 
 type QuietWriter struct{}
@@ -29,10 +33,11 @@ func (q QuietWriter) Write(p []byte) (int, error) {
 func init() {
 	flag.StringVar(&configFile, "config-file", "config.json", "Sensu JSON config file")
 	flag.StringVar(&configDir, "config-dir", "conf.d", "directory or comma-delimited directory list for Sensu JSON config files")
-	flag.StringVar(&statStoreFile, "stat-store", "", "The file to store results when we cannot get a RabbitMQ connection. defaults to the same location as config-file/config-dir")
+	flag.StringVar(&statStoreFile, "stat-store", "", "Where to store results when we cannot get a RabbitMQ connection. They are kept in the <stat-store>.wal directory, and an old single file stat store at this path is imported. Results are dropped while disconnected when empty")
 	flag.StringVar(&overrideHostName, "hostname", "", "A host name to use instead of the one found in the config")
 	flag.StringVar(&overrideAddress, "address", "", "An Address to override the one found in the config file")
 	flag.BoolVar(&quiet, "quiet", false, "When true makes all logger output go to dev null")
+	flag.StringVar(&controlSocket, "control-socket", "/var/run/sensu/sensu-client.sock", "The unix socket `sensu-client ctl` talks to us on. Empty to disable")
 	flag.Parse()
 }
 
@@ -56,20 +61,126 @@ func runner(stop chan bool) {
 		settings.Data().Get("client").Set("address", overrideAddress)
 	}
 
+	pluginProcessor := sensu.NewPluginProcessor(logOutput, statStoreFile)
+	subscriber := sensu.NewSubscriber(logOutput)
+	subscriber.CountWith(pluginProcessor)
 	processes := []sensu.Processor{
 		sensu.NewKeepalive(logOutput),
-		sensu.NewSubscriber(logOutput),
-		sensu.NewPluginProcessor(logOutput, statStoreFile),
+		subscriber,
+		pluginProcessor,
 	}
 	c := sensu.NewClient(settings, processes)
 
+	var exporter *sensu.PrometheusExporter
+	if "" != settings.Prometheus.Listen {
+		exporter = sensu.NewPrometheusExporter(logOutput, settings.Prometheus)
+		if err = exporter.Start(); nil != err {
+			log.Printf("Unable to start the metrics endpoint: %s", err)
+			exporter = nil
+		} else {
+			pluginProcessor.SetExporter(exporter)
+		}
+	}
+
+	var control *sensu.ControlServer
+	if "" != controlSocket {
+		control = sensu.NewControlServer(logOutput, controlSocket, pluginProcessor, func() {
+			// the same as being sent a HUP
+			syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		})
+		if err = control.Start(); nil != err {
+			log.Printf("Unable to start the control socket: %s", err)
+			control = nil
+		}
+	}
+
 	// our stop message is dequeued by the sensu-client
 	c.Start(stop)
+
+	// the next runner starts as soon as we say we are done, and wants the socket
+	// and port back
+	if nil != control {
+		control.Stop()
+	}
+	if nil != exporter {
+		exporter.Stop()
+	}
 	// now send back a message letting the caller know we are done!
 	stop <- true
 }
 
+// talks to a running client over its control socket
+func ctl(args []string) int {
+	usage := "Usage: sensu-client ctl list|run <check>|pause <check>|resume <check>|reload"
+	if 0 == len(args) {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	request := sensu.ControlRequest{Command: args[0]}
+	switch request.Command {
+	case "run", "pause", "resume":
+		if 2 != len(args) {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		request.Check = args[1]
+	case "list", "reload":
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	response, err := sensu.SendControlRequest(controlSocket, request)
+	if nil != err {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !response.Ok {
+		fmt.Fprintln(os.Stderr, response.Message)
+		return 1
+	}
+
+	if "list" != request.Command {
+		fmt.Println(response.Message)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSCHEDULE\tSTATUS\tSTATE\tLAST RUN\tNEXT RUN\tFAILURES\tSUBDUED\tSKIPPED\tLATE\tSUPPRESSED")
+	for _, job := range response.Jobs {
+		state := "active"
+		if job.Paused {
+			state = "paused"
+		} else if job.Flapping {
+			state = "flapping"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", job.Name, job.Schedule, ctlStatus(job.Status), state,
+			ctlTime(job.LastRun), ctlTime(job.NextRun), job.Failures, job.Subdued, job.Skipped, job.Late, job.Suppressed)
+	}
+	w.Flush()
+	return 0
+}
+
+func ctlStatus(status string) string {
+	if "" == status {
+		return "-"
+	}
+	return status
+}
+
+func ctlTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
 func main() {
+	if "ctl" == flag.Arg(0) {
+		os.Exit(ctl(flag.Args()[1:]))
+	}
+
 	if quiet {
 		logOutput = QuietWriter{}
 		log.SetOutput(QuietWriter{})
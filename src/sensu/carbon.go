@@ -0,0 +1,351 @@
+package sensu
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"plugins"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// where a check's metric results go, chosen by its route
+const (
+	routeRabbitmq = "rabbitmq" // the default
+	routeCarbon   = "carbon"   // straight to carbon, RabbitMQ never sees them
+	routeBoth     = "both"
+)
+
+const (
+	defaultCarbonPort          = 2003
+	defaultCarbonBatchSize     = 500   // lines written at once
+	defaultCarbonFlushInterval = 1000  // milliseconds between writes
+	defaultCarbonBufferSize    = 10000 // results held in memory when there is no disk buffer
+	carbonTimeout              = 10 * time.Second
+	carbonRetryMax             = 60 * time.Second
+	carbonDatagramSize         = 1400 // keeps udp writes inside a single packet
+)
+
+// sends metric results straight to a carbon server in graphite plain text.
+// results wait in a buffer, on disk when there is somewhere to put it, until
+// they have been written, so carbon going away loses nothing
+type carbonSink struct {
+	config CarbonConfig
+	logger *log.Logger
+	store  *statStore // the disk buffer, nil when results are buffered in memory
+
+	lock    sync.Mutex
+	memory  [][]byte
+	pending int // lines waiting since the last write
+	sent    int
+	dropped int
+
+	conn     net.Conn
+	failures int
+	retryAt  time.Time
+
+	ready chan bool
+	stop  chan bool
+	done  chan bool
+}
+
+func newCarbonSink(w io.Writer, config CarbonConfig, buffer string) (*carbonSink, error) {
+	c := new(carbonSink)
+	c.logger = log.New(w, "Carbon: ", log.LstdFlags)
+	c.config = config
+	if 0 == c.config.Port {
+		c.config.Port = defaultCarbonPort
+	}
+	if "" == c.config.Protocol {
+		c.config.Protocol = "tcp"
+	}
+	if "tcp" != c.config.Protocol && "udp" != c.config.Protocol {
+		return nil, fmt.Errorf("Unknown carbon protocol %q", c.config.Protocol)
+	}
+	if c.config.BatchSize <= 0 {
+		c.config.BatchSize = defaultCarbonBatchSize
+	}
+	if c.config.FlushInterval <= 0 {
+		c.config.FlushInterval = defaultCarbonFlushInterval
+	}
+	if c.config.BufferSize <= 0 {
+		c.config.BufferSize = defaultCarbonBufferSize
+	}
+
+	if "" != buffer {
+		store, err := openStatStore(buffer, c.config.Buffer.StatStoreConfig, c.logger)
+		if nil != err {
+			return nil, err
+		}
+		c.store = store
+	}
+
+	c.ready = make(chan bool, 1)
+	c.stop = make(chan bool)
+	c.done = make(chan bool)
+	return c, nil
+}
+
+func (c *carbonSink) address() string {
+	return net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+}
+
+func (c *carbonSink) Start() {
+	c.logger.Printf("START: Sending metrics to %s://%s", c.config.Protocol, c.address())
+	go c.run()
+}
+
+// writes out what it can and closes the buffer
+func (c *carbonSink) Stop() {
+	c.logger.Print("STOP: Shutting down the carbon sink")
+	close(c.stop)
+	<-c.done
+}
+
+// adds the graphite lines of a result to the buffer
+func (c *carbonSink) Send(lines []byte) {
+	if 0 == len(lines) {
+		return
+	}
+
+	c.lock.Lock()
+	if nil != c.store {
+		if err := c.store.Append(lines); nil != err {
+			c.logger.Printf("Cannot write to the carbon buffer: %v", err)
+			c.dropped++
+		}
+	} else {
+		if len(c.memory) >= c.config.BufferSize {
+			c.memory = c.memory[1:]
+			c.dropped++
+		}
+		c.memory = append(c.memory, lines)
+	}
+	c.pending += bytes.Count(lines, []byte("\n"))
+	full := c.pending >= c.config.BatchSize
+	c.lock.Unlock()
+
+	// no need to wait for the next flush when we have a batch ready
+	if full {
+		select {
+		case c.ready <- true:
+		default:
+		}
+	}
+}
+
+func (c *carbonSink) run() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(time.Duration(c.config.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ready:
+			c.flush()
+		case <-ticker.C:
+			c.flush()
+		case <-c.stop:
+			c.retryAt = time.Time{}
+			c.flush()
+			c.disconnect()
+			if nil != c.store {
+				c.store.Close()
+			}
+			return
+		}
+	}
+}
+
+// writes batches until the buffer is empty, or carbon stops taking them. after
+// a failure we wait longer and longer before trying again
+func (c *carbonSink) flush() {
+	if time.Now().Before(c.retryAt) {
+		return
+	}
+
+	for {
+		batch, done := c.take()
+		if 0 == len(batch) {
+			return
+		}
+
+		err := c.write(batch)
+		done(nil == err)
+
+		c.lock.Lock()
+		if nil != err {
+			c.failures++
+			wait := jobBackoff(time.Second, c.failures, carbonRetryMax)
+			c.lock.Unlock()
+			c.retryAt = time.Now().Add(wait)
+			c.logger.Printf("Unable to send metrics to %s, retrying in %s: %v", c.address(), wait, err)
+			return
+		}
+
+		if c.failures > 0 {
+			c.logger.Printf("Sending metrics to %s again", c.address())
+		}
+		c.failures = 0
+		lines := bytes.Count(batch, []byte("\n"))
+		c.sent += lines
+		if c.pending -= lines; c.pending < 0 {
+			c.pending = 0
+		}
+		c.lock.Unlock()
+	}
+}
+
+// takes up to a batch of lines off the buffer. done puts them back when they could not be sent
+func (c *carbonSink) take() ([]byte, func(sent bool)) {
+	var batch []byte
+	lines := 0
+
+	if nil != c.store {
+		var next walPosition
+		for lines < c.config.BatchSize {
+			payload, after, err := c.store.Next()
+			if nil != err {
+				if io.EOF != err {
+					c.logger.Printf("Unable to read the carbon buffer: %v", err)
+				}
+				break
+			}
+			batch = append(batch, payload...)
+			lines += bytes.Count(payload, []byte("\n"))
+			next = after
+		}
+		return batch, func(sent bool) {
+			if sent {
+				c.store.Commit(next)
+			} else {
+				c.store.Rewind()
+			}
+		}
+	}
+
+	c.lock.Lock()
+	taken := 0
+	for taken < len(c.memory) && lines < c.config.BatchSize {
+		batch = append(batch, c.memory[taken]...)
+		lines += bytes.Count(c.memory[taken], []byte("\n"))
+		taken++
+	}
+	results := c.memory[:taken:taken]
+	c.memory = c.memory[taken:]
+	c.lock.Unlock()
+
+	return batch, func(sent bool) {
+		if sent {
+			return
+		}
+		c.lock.Lock()
+		c.memory = append(results, c.memory...)
+		for len(c.memory) > c.config.BufferSize {
+			c.memory = c.memory[1:]
+			c.dropped++
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *carbonSink) write(batch []byte) error {
+	if nil != c.conn && c.closed() {
+		c.disconnect()
+	}
+	if nil == c.conn {
+		conn, err := net.DialTimeout(c.config.Protocol, c.address(), carbonTimeout)
+		if nil != err {
+			return err
+		}
+		c.conn = conn
+	}
+
+	var err error
+	c.conn.SetWriteDeadline(time.Now().Add(carbonTimeout))
+	if "udp" == c.config.Protocol {
+		err = c.writeDatagrams(batch)
+	} else {
+		_, err = c.conn.Write(batch)
+	}
+	if nil != err {
+		c.disconnect()
+	}
+	return err
+}
+
+// whole lines at a time, as many as fit in a packet
+func (c *carbonSink) writeDatagrams(batch []byte) error {
+	for len(batch) > 0 {
+		end := len(batch)
+		if end > carbonDatagramSize {
+			end = bytes.LastIndexByte(batch[:carbonDatagramSize], '\n') + 1
+			if end <= 0 {
+				end = bytes.IndexByte(batch, '\n') + 1
+				if end <= 0 {
+					end = len(batch)
+				}
+			}
+		}
+		if _, err := c.conn.Write(batch[:end]); nil != err {
+			return err
+		}
+		batch = batch[end:]
+	}
+	return nil
+}
+
+// carbon never says anything, so a tcp connection with something to read has
+// been closed. writing to it would be lost without an error
+func (c *carbonSink) closed() bool {
+	if "tcp" != c.config.Protocol {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.conn.Read(make([]byte, 1))
+	c.conn.SetReadDeadline(time.Time{})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+func (c *carbonSink) disconnect() {
+	if nil != c.conn {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// how the carbon sink is doing
+type CarbonStats struct {
+	Address       string `json:"address"`
+	Failing       bool   `json:"failing"`        // the last write failed
+	BufferedBytes int64  `json:"buffered_bytes"` // waiting to be sent
+	Sent          int    `json:"sent"`           // lines
+	Dropped       int    `json:"dropped"`        // results thrown away because the buffer was full
+}
+
+func (c *carbonSink) Stats() CarbonStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := CarbonStats{Address: c.address(), Failing: c.failures > 0, Sent: c.sent, Dropped: c.dropped}
+	if nil != c.store {
+		stats.BufferedBytes = c.store.Size()
+	} else {
+		for _, lines := range c.memory {
+			stats.BufferedBytes += int64(len(lines))
+		}
+	}
+	return stats
+}
+
+// the graphite lines for a metric result, whatever format it is published in
+func carbonLines(result *Result, rows []plugins.ResultStat) []byte {
+	return []byte(formatGraphitePoints(metricPoints(rows, result.ShortName(), result.wrapOutput, result.StartTime())))
+}
@@ -0,0 +1,197 @@
+package sensu
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"plugins"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a carbon server that hands us every line it is sent. closing it closes its
+// connections too, as a carbon server going away would
+type testCarbon struct {
+	listener net.Listener
+	lines    chan string
+	lock     sync.Mutex
+	conns    []net.Conn
+}
+
+func testCarbonServer(t *testing.T, address string) *testCarbon {
+	listener, err := net.Listen("tcp", address)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	server := &testCarbon{listener: listener, lines: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					server.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (s *testCarbon) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+}
+
+func testCarbonSink(t *testing.T, server *testCarbon, buffer string) *carbonSink {
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	config := CarbonConfig{Host: host, FlushInterval: 10, BatchSize: 2}
+	config.Port, _ = strconv.Atoi(port)
+
+	c, err := newCarbonSink(ioutil.Discard, config, buffer)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func expectCarbonLines(t *testing.T, lines chan string, expected ...string) {
+	for _, line := range expected {
+		select {
+		case received := <-lines:
+			if line != received {
+				t.Errorf("expected %q, got %q", line, received)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", line)
+		}
+	}
+}
+
+func Test_CarbonSink(t *testing.T) {
+	server := testCarbonServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	c := testCarbonSink(t, server, "")
+	c.Start()
+	defer c.Stop()
+
+	c.Send([]byte("stb.site.load_avg.one 0.5 1400000000\n"))
+	c.Send([]byte("stb.site.load_avg.five 0.25 1400000000\nstb.site.load_avg.fifteen 0.1 1400000000\n"))
+	expectCarbonLines(t, server.lines,
+		"stb.site.load_avg.one 0.5 1400000000",
+		"stb.site.load_avg.five 0.25 1400000000",
+		"stb.site.load_avg.fifteen 0.1 1400000000")
+
+	if stats := c.Stats(); 3 != stats.Sent || 0 != stats.BufferedBytes || stats.Failing {
+		t.Errorf("expected everything to be sent, got %+v", stats)
+	}
+}
+
+func Test_CarbonSinkReconnects(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	server := testCarbonServer(t, "127.0.0.1:0")
+	address := server.listener.Addr().String()
+
+	c := testCarbonSink(t, server, dir)
+	c.Start()
+	defer c.Stop()
+
+	c.Send([]byte("first 1 1400000000\n"))
+	expectCarbonLines(t, server.lines, "first 1 1400000000")
+
+	// carbon goes away, what we send waits in the buffer
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	c.Send([]byte("second 2 1400000000\n"))
+	time.Sleep(100 * time.Millisecond)
+	if stats := c.Stats(); 0 == stats.BufferedBytes {
+		t.Errorf("expected the result to wait in the buffer, got %+v", stats)
+	}
+
+	// and is sent once it is back
+	server = testCarbonServer(t, address)
+	defer server.Close()
+	expectCarbonLines(t, server.lines, "second 2 1400000000")
+}
+
+func Test_CarbonBufferConfig(t *testing.T) {
+	var config CarbonConfig
+	if err := json.Unmarshal([]byte(`{"buffer": "/var/cache/sensu/carbon"}`), &config); nil != err {
+		t.Fatal(err)
+	}
+	if "/var/cache/sensu/carbon" != config.Buffer.Path || 0 != config.Buffer.MaxSize {
+		t.Errorf("expected a plain string to be the path, got %+v", config.Buffer)
+	}
+
+	config = CarbonConfig{}
+	if err := json.Unmarshal([]byte(`{"buffer": {"path": "/var/cache/sensu/carbon", "max_size": 1048576, "max_age": 3600}}`), &config); nil != err {
+		t.Fatal(err)
+	}
+	if "/var/cache/sensu/carbon" != config.Buffer.Path || 1048576 != config.Buffer.MaxSize || 3600 != config.Buffer.MaxAge {
+		t.Errorf("expected the buffer to have its own limits, got %+v", config.Buffer)
+	}
+}
+
+// runs that are sending when the processor stops finish before the sink does
+func Test_CarbonStopWhileSending(t *testing.T) {
+	server := testCarbonServer(t, "127.0.0.1:0")
+	defer server.Close()
+
+	p := newTestProcessor(t)
+	p.carbon = testCarbonSink(t, server, "")
+	p.carbon.Start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100 && p.sendToCarbon([]byte("stb.site.load_avg.one 0.5 1400000000\n")); j++ {
+			}
+		}()
+	}
+	p.stopCarbon()
+	wg.Wait()
+
+	if p.sendToCarbon([]byte("late 1 1400000000\n")) {
+		t.Error("expected nothing to be sent once carbon has stopped")
+	}
+	if stats := p.Stats(); nil != stats.Carbon {
+		t.Errorf("expected no carbon stats once it has stopped, got %+v", stats.Carbon)
+	}
+}
+
+func Test_CarbonLines(t *testing.T) {
+	gathered := new(plugins.Result)
+	gathered.AddMetric("load_avg.one", 0.5, nil)
+
+	result := NewResult(ClientConfig{Name: "stb.site.loc"}, "load_metrics")
+	result.SetCheckConfig(plugins.PluginConfig{OutputFormat: formatJSON})
+	result.Check.Executed = 1400000000
+	result.SetOutput(gathered.Output())
+
+	// carbon always gets graphite, whatever the result is published as
+	if lines := string(carbonLines(result, gathered.Output())); "stb.site.load_avg.one 0.5 1400000000\n" != lines {
+		t.Errorf("expected graphite lines, got %q", lines)
+	}
+}
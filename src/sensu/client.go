@@ -25,6 +25,11 @@ func NewClient(c *Config, p []Processor) *Client {
 }
 
 func (c *Client) Start(stop chan bool) {
+	if c.config.Rabbitmq.Disabled {
+		c.startWithoutTransport(stop)
+		return
+	}
+
 	var disconnected chan *amqp.Error
 	connected := make(chan bool)
 
@@ -60,6 +65,23 @@ func (c *Client) Start(stop chan bool) {
 	}
 }
 
+// with RabbitMQ disabled our checks still run, for the Prometheus endpoint,
+// but their results go nowhere
+func (c *Client) startWithoutTransport(stop chan bool) {
+	log.Print("WARNING: RabbitMQ is disabled, keepalives and check results will not be sent anywhere")
+	q := new(noTransport)
+	for _, proc := range c.processes {
+		if err := proc.Init(q, c.config); err != nil {
+			log.Printf("Unable to start a process without RabbitMQ: %s", err)
+			continue
+		}
+		go proc.Start()
+	}
+
+	<-stop
+	c.Stop(true)
+}
+
 func (c *Client) Stop(force bool) {
 	log.Print("STOP: Closing down processes")
 	for _, proc := range c.processes {
@@ -72,3 +94,35 @@ func (c *Client) Shutdown() {
 	c.q.Disconnect()
 	c.Stop(true)
 }
+
+// a MessageQueuer that is always connected and throws everything away
+type noTransport struct{}
+
+func (n *noTransport) Connect(connected chan bool) {
+	connected <- true
+}
+
+func (n *noTransport) Disconnected() chan *amqp.Error {
+	return nil
+}
+
+func (n *noTransport) ExchangeDeclare(name string, kind string) error {
+	return nil
+}
+
+func (n *noTransport) QueueDeclare(name string, opts QueueOptions) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (n *noTransport) QueueBind(name, key, source string) error {
+	return nil
+}
+
+// nothing is ever delivered
+func (n *noTransport) Consume(name, consumer string) (<-chan amqp.Delivery, error) {
+	return make(chan amqp.Delivery), nil
+}
+
+func (n *noTransport) Publish(exchange string, key string, msg amqp.Publishing) error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package sensu
+
+import (
+	"plugins"
+	"sync/atomic"
+)
+
+// the name our own metrics are served under on the Prometheus endpoint
+const clientMetricsCheck = "sensu-client"
+
+// what the client counts about itself. the processor owns them and the
+// subscriber counts into the same ones, so a single number covers both
+type clientCounters struct {
+	truncated       int64               // results whose output was over the max_output_size
+	subduedRuns     int64               // scheduled runs skipped because the check was subdued
+	subduedRequests int64               // subscription requests dropped because the check was subdued
+	exporter        *PrometheusExporter // gets the counters each time they change, nil when not serving them
+}
+
+// adds one to a counter and lets Prometheus know
+func (c *clientCounters) add(counter *int64) int64 {
+	count := atomic.AddInt64(counter, 1)
+	if nil != c.exporter {
+		c.exporter.Update(clientMetricsCheck, c.metrics())
+	}
+	return count
+}
+
+func (c *clientCounters) metrics() []plugins.ResultStat {
+	return []plugins.ResultStat{
+		{Name: "sensu_client.truncated_results", Value: float64(atomic.LoadInt64(&c.truncated)), Counter: true},
+		{Name: "sensu_client.subdued_runs", Value: float64(atomic.LoadInt64(&c.subduedRuns)), Counter: true},
+		{Name: "sensu_client.subdued_requests", Value: float64(atomic.LoadInt64(&c.subduedRequests)), Counter: true},
+	}
+}
+
+func (c *clientCounters) countTruncated() int64 {
+	return c.add(&c.truncated)
+}
+
+func (c *clientCounters) countSubduedRun() int64 {
+	return c.add(&c.subduedRuns)
+}
+
+func (c *clientCounters) countSubduedRequest() int64 {
+	return c.add(&c.subduedRequests)
+}
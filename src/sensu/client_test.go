@@ -0,0 +1,63 @@
+package sensu
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a process that records how it was started
+type testProcess struct {
+	initErr error
+	queue   MessageQueuer
+	started chan bool
+	stopped bool
+}
+
+func (p *testProcess) Init(q MessageQueuer, c *Config) error {
+	p.queue = q
+	return p.initErr
+}
+
+func (p *testProcess) Start() {
+	p.started <- true
+}
+
+func (p *testProcess) Stop(force bool) {
+	p.stopped = true
+}
+
+func Test_ClientWithRabbitmqDisabled(t *testing.T) {
+	working := &testProcess{started: make(chan bool, 1)}
+	broken := &testProcess{started: make(chan bool, 1), initErr: errors.New("no queue for you")}
+
+	config := &Config{Rabbitmq: RabbitmqConfig{Disabled: true}}
+	c := NewClient(config, []Processor{broken, working})
+
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		c.Start(stop)
+		close(done)
+	}()
+
+	select {
+	case <-working.started:
+	case <-time.After(time.Second):
+		t.Fatal("expected the process to be started without RabbitMQ")
+	}
+	if _, ok := working.queue.(*noTransport); !ok {
+		t.Errorf("expected the process to be given no transport, got %T", working.queue)
+	}
+
+	stop <- true
+	<-done
+	if !working.stopped {
+		t.Error("expected the process to be stopped")
+	}
+	select {
+	case <-broken.started:
+		t.Error("expected a process that failed to initialise not to be started")
+	default:
+	}
+}
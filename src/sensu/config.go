@@ -11,10 +11,89 @@ import (
 )
 
 type ClientConfig struct {
-	Name          string   `json:"name"`
-	Address       string   `json:"address"`
-	Version       string   `json:"version"`
-	Subscriptions []string `json:"subscriptions"`
+	Name              string                  `json:"name"`
+	Address           string                  `json:"address"`
+	Version           string                  `json:"version"`
+	Subscriptions     []string                `json:"subscriptions"`
+	SubscriptionQueue SubscriptionQueueConfig `json:"subscription_queue"`
+	SplayCoverage     int                     `json:"splay_coverage"` // percentage of each interval our checks are splayed over
+	Timezone          string                  `json:"timezone"`       // time zone for cron checks, defaults to the local time zone
+	MetricPrefix      string                  `json:"metric_prefix"`  // template for the start of our metric names
+
+	MaxConcurrentChecks int `json:"max_concurrent_checks"` // the most checks we run at once, no limit when 0
+	MaxOutputSize       int `json:"max_output_size"`       // bytes of output kept in each result, no limit when 0
+}
+
+// how the queue for our subscriptions is declared. by default every connection
+// gets a new auto-delete queue, so requests sent while we are offline are lost
+type SubscriptionQueueConfig struct {
+	Name       string `json:"name"`        // fixed queue name, defaults to <client name>-<version>
+	Stable     bool   `json:"stable"`      // keep the same queue across reconnects
+	Durable    bool   `json:"durable"`     // the queue survives a RabbitMQ restart
+	MessageTTL int    `json:"message_ttl"` // seconds a request may wait in the queue before it is dropped
+	MaxLength  int    `json:"max_length"`  // the most requests the queue holds, the oldest are dropped first
+	Expires    int    `json:"expires"`     // seconds a stable queue lives once we stop consuming, forever when 0
+
+	MaxRetries         int    `json:"max_retries"`          // times a failing request is requeued before giving up on it
+	DeadLetterExchange string `json:"dead_letter_exchange"` // where requests we cannot handle are sent
+	DeadLetterQueue    string `json:"dead_letter_queue"`    // bound to the dead letter exchange, defaults to its name
+}
+
+// how results are kept on disk while we cannot reach RabbitMQ
+type StatStoreConfig struct {
+	Fsync         string `json:"fsync"`          // "always", "interval" or "never"
+	FsyncInterval int    `json:"fsync_interval"` // seconds between syncs with the interval policy
+	SegmentSize   int64  `json:"segment_size"`   // bytes written to a segment before the next one is started
+	MaxSize       int64  `json:"max_size"`       // bytes kept before the oldest results are dropped
+	MaxAge        int    `json:"max_age"`        // seconds results are kept for, forever when 0
+	Compression   string `json:"compression"`    // "gzip" or "zstd" to compress segments once they are full
+}
+
+// how results are sent on to RabbitMQ
+type ResultsConfig struct {
+	BatchSize   int  `json:"batch_size"`   // results sent together in one message, no batching when 0 or 1
+	BatchWait   int  `json:"batch_wait"`   // milliseconds a batch waits to fill up before it is sent anyway
+	BatchChecks bool `json:"batch_checks"` // batch check results too, not just metrics and replayed results
+
+	QueueSize     int    `json:"queue_size"`     // results held in memory waiting to be published
+	Overflow      string `json:"overflow"`       // "drop_oldest", "drop_newest" or "spill" to the stat store when the queue is full
+	RetryInterval int    `json:"retry_interval"` // seconds between attempts at publishing results that failed
+	ReplayRate    int    `json:"replay_rate"`    // stored results replayed per second, no limit when 0
+}
+
+// a carbon server metric results can be sent to directly, see the check route
+type CarbonConfig struct {
+	Host          string             `json:"host"`
+	Port          int                `json:"port"`           // defaults to 2003
+	Protocol      string             `json:"protocol"`       // "tcp" (the default) or "udp"
+	BatchSize     int                `json:"batch_size"`     // lines written at once
+	FlushInterval int                `json:"flush_interval"` // milliseconds between writes
+	Buffer        CarbonBufferConfig `json:"buffer"`         // on disk until they are sent
+	BufferSize    int                `json:"buffer_size"`    // results held in memory when there is no buffer directory
+}
+
+// where metrics wait on disk until carbon has them, with limits of its own
+// rather than the stat store's. a plain string is taken as the path
+type CarbonBufferConfig struct {
+	Path string `json:"path"` // defaults to <stat-store>.carbon
+	StatStoreConfig
+}
+
+func (b *CarbonBufferConfig) UnmarshalJSON(data []byte) error {
+	var path string
+	if nil == json.Unmarshal(data, &path) {
+		*b = CarbonBufferConfig{Path: path}
+		return nil
+	}
+
+	type bufferConfig CarbonBufferConfig // without this method, or we would never return
+	return json.Unmarshal(data, (*bufferConfig)(b))
+}
+
+// where Prometheus can scrape our metrics, off when there is no listen address
+type PrometheusConfig struct {
+	Listen string `json:"listen"` // e.g. ":9100"
+	Path   string `json:"path"`   // defaults to /metrics
 }
 
 type RabbitmqConfigSSL struct {
@@ -29,13 +108,18 @@ type RabbitmqConfig struct {
 	User     string            `json:"user"`
 	Password string            `json:"password"`
 	Ssl      RabbitmqConfigSSL `json:"ssl"`
+	Disabled bool              `json:"disabled"` // run without RabbitMQ, keepalives and results go nowhere
 }
 
 type Config struct {
-	Checks   map[string]Check `json:"checks"`
-	Client   ClientConfig     `json:"client"`
-	Rabbitmq RabbitmqConfig   `json:"rabbitmq"`
-	rawData  *simplejson.Json
+	Checks     map[string]Check `json:"checks"`
+	Client     ClientConfig     `json:"client"`
+	Rabbitmq   RabbitmqConfig   `json:"rabbitmq"`
+	StatStore  StatStoreConfig  `json:"stat_store"`
+	Results    ResultsConfig    `json:"results"`
+	Prometheus PrometheusConfig `json:"prometheus"`
+	Carbon     CarbonConfig     `json:"carbon"`
+	rawData    *simplejson.Json
 }
 
 func LoadConfigs(configFile string, configDirs []string) (*Config, error) {
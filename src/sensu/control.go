@@ -0,0 +1,183 @@
+package sensu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const controlTimeout = 10 * time.Second
+
+// a request sent down the control socket, one JSON line per connection
+type ControlRequest struct {
+	Command string `json:"command"`
+	Check   string `json:"check,omitempty"`
+}
+
+type ControlResponse struct {
+	Ok      bool      `json:"ok"`
+	Message string    `json:"message,omitempty"`
+	Jobs    []JobInfo `json:"jobs,omitempty"`
+}
+
+// lets `sensu-client ctl` list, run, pause and resume our scheduled checks and
+// reload our config while we are running
+type ControlServer struct {
+	path     string
+	proc     *PluginProcessor
+	reload   func()
+	logger   *log.Logger
+	listener net.Listener
+}
+
+func NewControlServer(w io.Writer, path string, proc *PluginProcessor, reload func()) *ControlServer {
+	s := new(ControlServer)
+	s.logger = log.New(w, "Control: ", log.LstdFlags)
+	s.path = path
+	s.proc = proc
+	s.reload = reload
+	return s
+}
+
+func (s *ControlServer) Start() error {
+	if err := controlSocketDir(filepath.Dir(s.path)); nil != err {
+		return err
+	}
+
+	// a socket left behind by a client that did not shut down cleanly
+	if _, err := os.Stat(s.path); nil == err {
+		if conn, err := net.Dial("unix", s.path); nil == err {
+			conn.Close()
+			return fmt.Errorf("Control socket %s is already in use", s.path)
+		}
+		os.Remove(s.path)
+	}
+
+	// the socket is only ever ours, there is no moment it is open to anyone else
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", s.path)
+	syscall.Umask(umask)
+	if nil != err {
+		return fmt.Errorf("Control socket: %s", err)
+	}
+
+	s.listener = listener
+	s.logger.Printf("Listening on %s", s.path)
+	go s.serve(listener)
+	return nil
+}
+
+// anyone who can write to the directory could swap our socket for their own,
+// so it has to belong to us and no one else may write to it
+func controlSocketDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return fmt.Errorf("Control socket: %s", err)
+	}
+	info, err := os.Lstat(dir)
+	if nil != err {
+		return fmt.Errorf("Control socket: %s", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || 0 != info.Mode().Perm()&0022 {
+		return fmt.Errorf("Control socket: %s must be a directory of our own that no one else can write to", dir)
+	}
+	return nil
+}
+
+func (s *ControlServer) Stop() {
+	if nil != s.listener {
+		s.logger.Print("STOP: Closing control socket")
+		s.listener.Close() // removes the socket file too
+		s.listener = nil
+	}
+}
+
+func (s *ControlServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if nil != err {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var request ControlRequest
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if nil != err && 0 == len(line) {
+		s.logger.Printf("Failed to read request: %v", err)
+		return
+	}
+
+	var response ControlResponse
+	if err = json.Unmarshal(line, &request); nil != err {
+		response.Message = fmt.Sprintf("Invalid request: %s", err)
+	} else {
+		response = s.execute(request)
+	}
+
+	if err = json.NewEncoder(conn).Encode(response); nil != err {
+		s.logger.Printf("Failed to send response: %v", err)
+	}
+
+	// answer first, the reload stops everything including us
+	if response.Ok && "reload" == request.Command {
+		s.reload()
+	}
+}
+
+func (s *ControlServer) execute(request ControlRequest) ControlResponse {
+	s.logger.Printf("Received: %s %s", request.Command, request.Check)
+
+	var err error
+	switch request.Command {
+	case "list":
+		return ControlResponse{Ok: true, Jobs: s.proc.Jobs()}
+	case "run":
+		err = s.proc.RunJob(request.Check)
+	case "pause":
+		err = s.proc.PauseJob(request.Check)
+	case "resume":
+		err = s.proc.ResumeJob(request.Check)
+	case "reload":
+		return ControlResponse{Ok: true, Message: "Reloading"}
+	default:
+		err = fmt.Errorf("Unknown command: %q", request.Command)
+	}
+
+	if nil != err {
+		return ControlResponse{Message: err.Error()}
+	}
+	return ControlResponse{Ok: true, Message: fmt.Sprintf("%s: %s", request.Command, request.Check)}
+}
+
+// sends a single request down the control socket and waits for the answer
+func SendControlRequest(path string, request ControlRequest) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, controlTimeout)
+	if nil != err {
+		return nil, fmt.Errorf("Unable to reach the client on %s: %s", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if err = json.NewEncoder(conn).Encode(request); nil != err {
+		return nil, err
+	}
+
+	response := new(ControlResponse)
+	if err = json.NewDecoder(conn).Decode(response); nil != err {
+		return nil, fmt.Errorf("Invalid response: %s", err)
+	}
+	return response, nil
+}
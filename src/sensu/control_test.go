@@ -0,0 +1,123 @@
+package sensu
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"plugins"
+	"testing"
+)
+
+func Test_ControlServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-control")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	p := newTestProcessor(t)
+	p.AddJob(&slowJob{}, plugins.PluginConfig{Name: "slow", Command: "slow", Interval: 30})
+
+	reloaded := make(chan bool, 1)
+	s := NewControlServer(ioutil.Discard, path, p, func() { reloaded <- true })
+	if err = s.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	if info, err := os.Stat(path); nil != err || 0600 != info.Mode().Perm() {
+		t.Errorf("expected the socket to be ours alone, got %v %v", info.Mode(), err)
+	}
+
+	send := func(command, check string) *ControlResponse {
+		response, err := SendControlRequest(path, ControlRequest{Command: command, Check: check})
+		if nil != err {
+			t.Fatalf("%s %s: %s", command, check, err)
+		}
+		return response
+	}
+
+	if response := send("pause", "slow"); !response.Ok {
+		t.Errorf("expected pause to succeed: %s", response.Message)
+	}
+
+	response := send("list", "")
+	if 1 != len(response.Jobs) {
+		t.Fatalf("expected 1 job, got %d", len(response.Jobs))
+	}
+	if job := response.Jobs[0]; "slow" != job.Name || "every 30s" != job.Schedule || !job.Paused {
+		t.Errorf("unexpected job: %+v", job)
+	}
+
+	if response = send("run", "slow"); !response.Ok {
+		t.Errorf("expected run to succeed: %s", response.Message)
+	}
+	if response = send("run", "slow"); response.Ok {
+		t.Error("expected a second run to be refused while the first is waiting")
+	}
+	if response = send("resume", "missing"); response.Ok {
+		t.Error("expected an unknown check to be refused")
+	}
+	if response = send("stats", ""); response.Ok {
+		t.Error("expected stats to be refused")
+	}
+	if response = send("bogus", ""); response.Ok {
+		t.Error("expected an unknown command to be refused")
+	}
+
+	if response = send("reload", ""); !response.Ok {
+		t.Errorf("expected reload to succeed: %s", response.Message)
+	}
+	<-reloaded
+}
+
+func Test_ControlServerStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-control")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "control.sock")
+
+	// left behind by a client that died
+	ioutil.WriteFile(path, nil, 0600)
+
+	s := NewControlServer(ioutil.Discard, path, newTestProcessor(t), func() {})
+	if err = s.Start(); nil != err {
+		t.Fatalf("expected the stale socket to be replaced: %s", err)
+	}
+	defer s.Stop()
+
+	// a second server must not steal a live socket
+	if err = NewControlServer(ioutil.Discard, path, newTestProcessor(t), func() {}).Start(); nil == err {
+		t.Error("expected a live socket to be left alone")
+	}
+}
+
+func Test_ControlServerSharedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensu-control")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// anyone could replace the socket in a directory like /tmp
+	os.Chmod(dir, 0777|os.ModeSticky)
+	s := NewControlServer(ioutil.Discard, filepath.Join(dir, "control.sock"), newTestProcessor(t), func() {})
+	if err = s.Start(); nil == err {
+		s.Stop()
+		t.Error("expected a directory others can write to be refused")
+	}
+
+	// a directory that is not there yet is made for us alone
+	path := filepath.Join(dir, "run", "control.sock")
+	s = NewControlServer(ioutil.Discard, path, newTestProcessor(t), func() {})
+	if err = s.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if info, err := os.Stat(filepath.Dir(path)); nil != err || 0700 != info.Mode().Perm() {
+		t.Errorf("expected the socket directory to be ours alone, got %v %v", info.Mode(), err)
+	}
+}
@@ -0,0 +1,210 @@
+package sensu
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// when a job should next run
+type schedule interface {
+	Next(time.Time) time.Time
+}
+
+// runs a job every interval, the classic sensu way
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// runs a job at wall clock times described by a cron expression
+//
+// the 5 fields are: minute hour day-of-month month day-of-week
+// each field takes *, a number, a range (1-5), a step (*/15, 0-30/10) or a
+// comma separated list of any of those. months and days of the week may also
+// be given by name (jan, mon). sunday is 0 or 7.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of the allowed values
+	domStar, dowStar              bool   // whether the day fields were left as *
+	location                      *time.Location
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// turns a cron expression into a schedule. as well as the standard 5 fields
+// we take the usual @daily style shortcuts and "@every <duration>"
+func parseCron(spec string, location *time.Location) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if nil == location {
+		location = time.Local
+	}
+
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if nil != err {
+			return nil, fmt.Errorf("Invalid @every duration in %q: %s", spec, err)
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("The @every duration must be positive: %q", spec)
+		}
+		return intervalSchedule{interval}, nil
+	}
+
+	if expanded, ok := cronShortcuts[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if 5 != len(fields) {
+		return nil, fmt.Errorf("Expected 5 fields in cron expression %q, found %d", spec, len(fields))
+	}
+
+	var err error
+	s := &cronSchedule{location: location}
+	if s.minute, err = cronMinute.parse(fields[0]); nil != err {
+		return nil, err
+	}
+	if s.hour, err = cronHour.parse(fields[1]); nil != err {
+		return nil, err
+	}
+	if s.dom, err = cronDom.parse(fields[2]); nil != err {
+		return nil, err
+	}
+	if s.month, err = cronMonth.parse(fields[3]); nil != err {
+		return nil, err
+	}
+	if s.dow, err = cronDow.parse(fields[4]); nil != err {
+		return nil, err
+	}
+	// 7 is another name for sunday
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = "*" == fields[2]
+	s.dowStar = "*" == fields[4]
+
+	return s, nil
+}
+
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if nil != err || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in cron field %q", field)
+			}
+			part = part[:i]
+		}
+
+		low, high := f.min, f.max
+		if "*" != part {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = f.value(bounds[0]); nil != err {
+				return 0, err
+			}
+			high = low
+			if 2 == len(bounds) {
+				if high, err = f.value(bounds[1]); nil != err {
+					return 0, err
+				}
+			} else if step > 1 {
+				// 5/15 means starting at 5, every 15
+				high = f.max
+			}
+		}
+
+		if low > high {
+			return 0, fmt.Errorf("Invalid range in cron field %q", field)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if nil != err {
+		return 0, fmt.Errorf("Invalid value in cron expression: %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("Cron value %d out of range (%d-%d)", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+// finds the first matching minute after t
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute).Add(time.Minute)
+
+	// give up if nothing matches within 5 years (e.g. the 31st of february)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.location)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.location)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// as with cron, when both day fields are restricted either may match
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,66 @@
+package sensu
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_CronNext(t *testing.T) {
+	utc := time.UTC
+	// a wednesday
+	now := time.Date(2015, time.June, 10, 13, 45, 30, 0, utc)
+
+	for i, tuple := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2015, time.June, 10, 13, 46, 0, 0, utc)},
+		{"0 2 * * *", time.Date(2015, time.June, 11, 2, 0, 0, 0, utc)},
+		{"@daily", time.Date(2015, time.June, 11, 0, 0, 0, 0, utc)},
+		{"@hourly", time.Date(2015, time.June, 10, 14, 0, 0, 0, utc)},
+		{"*/15 * * * *", time.Date(2015, time.June, 10, 14, 0, 0, 0, utc)},
+		{"5/20 14 * * *", time.Date(2015, time.June, 10, 14, 5, 0, 0, utc)},
+		{"30 9 * * mon-fri", time.Date(2015, time.June, 11, 9, 30, 0, 0, utc)},
+		{"0 0 * * 7", time.Date(2015, time.June, 14, 0, 0, 0, 0, utc)},
+		{"0 0 1 jan *", time.Date(2016, time.January, 1, 0, 0, 0, 0, utc)},
+		{"0 12 1,15 * *", time.Date(2015, time.June, 15, 12, 0, 0, 0, utc)},
+		// restricting both day fields matches either of them
+		{"0 0 1 * sat", time.Date(2015, time.June, 13, 0, 0, 0, 0, utc)},
+		{"@every 90s", now.Add(90 * time.Second)},
+	} {
+		sched, err := parseCron(tuple.spec, utc)
+		if nil != err {
+			t.Errorf("%d. %q failed to parse: %s", i, tuple.spec, err)
+			continue
+		}
+		if next := sched.Next(now); !next.Equal(tuple.expected) {
+			t.Errorf("%d. %q expected %s, got %s", i, tuple.spec, tuple.expected, next)
+		}
+	}
+}
+
+func Test_CronTimezone(t *testing.T) {
+	location := time.FixedZone("AEST", 10*60*60)
+	sched, err := parseCron("0 2 * * *", location)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	next := sched.Next(time.Date(2015, time.June, 10, 0, 0, 0, 0, time.UTC))
+	if expected := time.Date(2015, time.June, 10, 16, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("expected 02:00 AEST (%s), got %s", expected, next.UTC())
+	}
+}
+
+func Test_CronInvalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "@every", "@every -1m", "@sometimes"} {
+		if _, err := parseCron(spec, time.UTC); nil == err {
+			t.Errorf("expected %q to fail to parse", spec)
+		}
+	}
+
+	sched, _ := parseCron("0 0 31 2 *", time.UTC)
+	if next := sched.Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected the 31st of february to never happen, got %s", next)
+	}
+}
@@ -0,0 +1,63 @@
+package sensu
+
+import (
+	"fmt"
+	"plugins"
+)
+
+// what to do with a check while one of its dependencies is failing
+const (
+	dependencySkip   = "skip"   // don't run it at all
+	dependencyReport = "report" // don't run it, tell the server why instead
+)
+
+// finds the first of a check's dependencies that is currently failing on this
+// client. dependencies that have not run yet, or that we don't run, are ignored
+func (p *PluginProcessor) failedDependency(name string, config plugins.PluginConfig) (string, plugins.Status, bool) {
+	for _, dependency := range config.Dependencies {
+		// two checks that depend on each other would keep each other from ever running again
+		if dependency == name || p.dependsOn(dependency, name, map[string]bool{}) {
+			continue
+		}
+
+		state, ok := p.findJobState(dependency)
+		if !ok {
+			continue
+		}
+		if status, ok := state.lastStatus(); ok && plugins.OK != status {
+			return dependency, status, true
+		}
+	}
+	return "", plugins.OK, false
+}
+
+// whether or not check depends on target, directly or through other checks
+func (p *PluginProcessor) dependsOn(check, target string, seen map[string]bool) bool {
+	if seen[check] {
+		return false
+	}
+	seen[check] = true
+
+	config, _, ok := p.jobConfig(check)
+	if !ok {
+		return false
+	}
+	for _, dependency := range config.Dependencies {
+		if dependency == target || p.dependsOn(dependency, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// a check result telling the server that a check was not run because something it depends on is failing
+func newDependencyResult(clientConfig ClientConfig, check_name string, config plugins.PluginConfig, dependency string, status plugins.Status) *Result {
+	result := NewResult(clientConfig, check_name)
+	result.SetCheckConfig(config)
+	result.SetType("check")
+	result.SetHandlers(config.Handlers)
+	result.SetStatus(plugins.UNKNOWN.ToInt())
+	result.SetCheckStatus("DEPENDENT-FAILURE")
+	result.SetOutput([]plugins.ResultStat{{Output: fmt.Sprintf("%s is %s", dependency, status.ToString())}})
+	return result
+}
@@ -0,0 +1,99 @@
+package sensu
+
+import (
+	"plugins"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_FailedDependency(t *testing.T) {
+	p := newTestProcessor(t)
+	job := &slowJob{}
+	p.AddJob(job, plugins.PluginConfig{Name: "uplink", Interval: 15})
+	p.AddJob(job, plugins.PluginConfig{Name: "tcp_metrics", Interval: 15, Dependencies: []string{"missing", "uplink"}})
+
+	config, _, _ := p.jobConfig("tcp_metrics")
+	if _, _, failing := p.failedDependency("tcp_metrics", config); failing {
+		t.Error("expected a dependency that has not run to be ignored")
+	}
+
+	p.jobState("uplink").record(plugins.CRITICAL, 0, 0)
+	dependency, status, failing := p.failedDependency("tcp_metrics", config)
+	if !failing || "uplink" != dependency || plugins.CRITICAL != status {
+		t.Errorf("expected uplink to be failing, got %q %s %v", dependency, status.ToString(), failing)
+	}
+
+	p.jobState("uplink").record(plugins.OK, 0, 0)
+	if _, _, failing = p.failedDependency("tcp_metrics", config); failing {
+		t.Error("expected the dependency to have recovered")
+	}
+}
+
+func Test_FailedDependencyCycle(t *testing.T) {
+	p := newTestProcessor(t)
+	job := &slowJob{}
+	p.AddJob(job, plugins.PluginConfig{Name: "a", Interval: 15, Dependencies: []string{"b"}})
+	p.AddJob(job, plugins.PluginConfig{Name: "b", Interval: 15, Dependencies: []string{"c"}})
+	p.AddJob(job, plugins.PluginConfig{Name: "c", Interval: 15, Dependencies: []string{"a"}})
+	for _, name := range []string{"a", "b", "c"} {
+		p.jobState(name).record(plugins.CRITICAL, 0, 0)
+	}
+
+	config, _, _ := p.jobConfig("a")
+	if _, _, failing := p.failedDependency("a", config); failing {
+		t.Error("expected checks that depend on each other not to block each other")
+	}
+}
+
+func Test_ParseStatus(t *testing.T) {
+	var tests = []struct {
+		description string
+		status      plugins.Status
+		ok          bool
+	}{
+		{"CheckProcs CRITICAL", plugins.CRITICAL, true},
+		{"uplink OK", plugins.OK, true},
+		{"WARNING", plugins.WARNING, true},
+		{"", plugins.OK, false},
+		{"nothing to see", plugins.OK, false},
+	}
+
+	for _, test := range tests {
+		status, ok := plugins.ParseStatus(test.description)
+		if test.status != status || test.ok != ok {
+			t.Errorf("ParseStatus(%q) = %s %v, expected %s %v", test.description, status.ToString(), ok, test.status.ToString(), test.ok)
+		}
+	}
+}
+
+func Test_DependencyReportIsHeldAndSuppressed(t *testing.T) {
+	p := newTestProcessor(t)
+	job := &slowJob{}
+	config := plugins.PluginConfig{Name: "tcp_metrics", Interval: 15, Dependencies: []string{"uplink"},
+		DependencyAction: dependencyReport, Occurrences: 2, Publish: publishChange}
+	p.AddJob(job, plugins.PluginConfig{Name: "uplink", Interval: 15})
+	p.AddJob(job, config)
+	p.jobState("uplink").record(plugins.CRITICAL, 0, 0)
+
+	// held back until it has happened often enough, then only sent again when it changes
+	for i, expected := range []int{0, 1, 1} {
+		p.runJob("tcp_metrics", job, config)
+		if queued := p.results.Len(); expected != queued {
+			t.Errorf("run %d: expected %d reports queued, got %d", i, expected, queued)
+		}
+	}
+	if 0 != atomic.LoadInt32(&job.most) {
+		t.Error("expected the check itself not to run")
+	}
+
+	// the reports are not the check's own status, so checks that depend on it
+	// do not see it failing
+	if _, ok := p.jobState("tcp_metrics").lastStatus(); ok {
+		t.Error("expected the reports to stay out of the check's history")
+	}
+	p.AddJob(job, plugins.PluginConfig{Name: "tcp_graphs", Interval: 15, Dependencies: []string{"tcp_metrics"}})
+	graphs, _, _ := p.jobConfig("tcp_graphs")
+	if _, _, failing := p.failedDependency("tcp_graphs", graphs); failing {
+		t.Error("expected a failing dependency not to cascade through a report")
+	}
+}
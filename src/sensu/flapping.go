@@ -0,0 +1,40 @@
+package sensu
+
+import (
+	"plugins"
+)
+
+// as with sensu, we need 21 results before we can tell whether a check is flapping
+const flapHistorySize = 21
+
+// the sensu flap detection algorithm: the percentage of the last 20 results
+// that were a change of state, with recent changes weighing more than old ones
+func totalStateChange(history []plugins.Status) int {
+	if len(history) < flapHistorySize {
+		return 0
+	}
+
+	changes := 0.0
+	weight := 0.8
+	previous := history[0]
+	for _, status := range history {
+		if status != previous {
+			changes += weight
+		}
+		weight += 0.02
+		previous = status
+	}
+	return int(changes / 20 * 100)
+}
+
+// a check starts flapping once its state change reaches the high threshold and
+// stops once it drops to the low threshold. both thresholds need to be set
+func isFlapping(wasFlapping bool, change, low, high int) bool {
+	if low <= 0 || high <= 0 {
+		return false
+	}
+	if wasFlapping {
+		return change > low
+	}
+	return change >= high
+}
@@ -0,0 +1,86 @@
+package sensu
+
+import (
+	"plugins"
+	"testing"
+)
+
+func flapHistory(statuses ...plugins.Status) []plugins.Status {
+	history := make([]plugins.Status, 0, flapHistorySize)
+	for len(history) < flapHistorySize {
+		history = append(history, statuses...)
+	}
+	return history[:flapHistorySize]
+}
+
+func Test_TotalStateChange(t *testing.T) {
+	var tests = []struct {
+		history  []plugins.Status
+		expected int
+	}{
+		{flapHistory(plugins.OK), 0},
+		{flapHistory(plugins.OK, plugins.WARNING), 101}, // recent changes weigh more, so this tops 100
+		{flapHistory(plugins.OK, plugins.OK, plugins.WARNING, plugins.WARNING), 51},
+		{flapHistory(plugins.OK, plugins.WARNING)[:20], 0}, // not enough history yet
+	}
+
+	for i, test := range tests {
+		if change := totalStateChange(test.history); test.expected != change {
+			t.Errorf("%d: expected a state change of %d, got %d", i, test.expected, change)
+		}
+	}
+}
+
+func Test_IsFlapping(t *testing.T) {
+	var tests = []struct {
+		wasFlapping       bool
+		change, low, high int
+		expected          bool
+	}{
+		{false, 60, 0, 0, false},
+		{false, 60, 20, 50, true},
+		{false, 40, 20, 50, false},
+		{true, 40, 20, 50, true},
+		{true, 20, 20, 50, false},
+	}
+
+	for i, test := range tests {
+		if flapping := isFlapping(test.wasFlapping, test.change, test.low, test.high); test.expected != flapping {
+			t.Errorf("%d: expected flapping to be %v", i, test.expected)
+		}
+	}
+}
+
+func Test_JobStateRecord(t *testing.T) {
+	state := new(jobState)
+
+	var history []string
+	var flapping bool
+	var occurrences int
+	for i := 0; i < flapHistorySize+5; i++ {
+		status := plugins.OK
+		if 0 == i%2 {
+			status = plugins.WARNING
+		}
+		history, flapping, occurrences = state.record(status, 20, 50)
+	}
+
+	if flapHistorySize != len(history) {
+		t.Errorf("expected the history to be capped at %d, got %d", flapHistorySize, len(history))
+	}
+	if "0" != history[len(history)-1] {
+		t.Errorf("expected the latest status last, got %v", history)
+	}
+	if !flapping {
+		t.Error("expected a check that changes every run to be flapping")
+	}
+	if 1 != occurrences {
+		t.Errorf("expected 1 occurrence, got %d", occurrences)
+	}
+
+	state.record(plugins.WARNING, 20, 50)
+	state.record(plugins.WARNING, 20, 50)
+	if _, _, occurrences = state.record(plugins.WARNING, 20, 50); 3 != occurrences {
+		t.Errorf("expected 3 occurrences, got %d", occurrences)
+	}
+}
@@ -0,0 +1,121 @@
+package sensu
+
+import (
+	"context"
+	"os/exec"
+	"plugins"
+	"strings"
+	"time"
+)
+
+// how many seconds a hook gets to run when its timeout isn't set
+const defaultHookTimeout = 10
+
+// the hook for any status other than ok, when there is none for the status itself
+const hookNonZero = "non-zero"
+
+// the output of a hook, sent along with the check result
+type hookResult struct {
+	Name     string  `json:"name"`     // the status the hook ran for
+	Command  string  `json:"command"`  // what was run
+	Output   string  `json:"output"`   // stdout and stderr together
+	Status   int     `json:"status"`   // the exit status of the command, -1 if it did not finish
+	Executed uint    `json:"executed"` // timestamp for when the hook was started
+	Duration float64 `json:"duration"` // how long it ran for, in seconds
+}
+
+// finds the hook for a status: ok, warning, critical, unknown or, failing those, non-zero
+func hookFor(hooks map[string]plugins.Hook, status plugins.Status) (string, plugins.Hook, bool) {
+	name := strings.ToLower(status.ToString())
+	if hook, ok := hooks[name]; ok {
+		return name, hook, true
+	}
+	if plugins.OK != status {
+		if hook, ok := hooks[hookNonZero]; ok {
+			return hookNonZero, hook, true
+		}
+	}
+	return "", plugins.Hook{}, false
+}
+
+// keeps the first max bytes written to it, all of them when max is negative,
+// and counts the rest
+type limitedBuffer struct {
+	max   int
+	data  []byte
+	total int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.total += len(p)
+	if room := b.max - len(b.data); b.max < 0 || room >= len(p) {
+		b.data = append(b.data, p...)
+	} else if room > 0 {
+		b.data = append(b.data, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// runs a hook through the shell so that pipes work, killing it if it runs for
+// too long. at most max bytes of its output are kept, all of it when max is negative
+func runHook(name string, hook plugins.Hook, max int) hookResult {
+	timeout := time.Duration(hook.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHookTimeout * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := hookResult{Name: name, Command: hook.Command}
+	started := time.Now()
+	result.Executed = uint(started.Unix())
+
+	out := &limitedBuffer{max: max}
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Command)
+	cmd.WaitDelay = time.Second // don't wait on children of the shell that outlive it
+	cmd.Stdout, cmd.Stderr = out, out
+	err := cmd.Run()
+	result.Duration = time.Since(started).Seconds()
+
+	var reason string
+	if context.DeadlineExceeded == ctx.Err() {
+		result.Status = -1
+		reason = "hook timed out after " + timeout.String()
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		result.Status = exitErr.ExitCode()
+	} else if nil != err {
+		result.Status = -1
+		reason = err.Error()
+	}
+
+	result.Output = string(out.data) + reason
+	if total := out.total + len(reason); max >= 0 && total > max {
+		result.Output = truncateOutput(result.Output, total, max)
+	}
+	return result
+}
+
+// runs the hook for a status, if there is one, and attaches its output to the
+// result. the hook gets whatever room the check output leaves in max_output_size
+func (r *Result) runHooks(hooks map[string]plugins.Hook, status plugins.Status) (hookResult, bool) {
+	name, hook, ok := hookFor(hooks, status)
+	if !ok {
+		return hookResult{}, false
+	}
+
+	max := r.outputLimit()
+	if max >= 0 {
+		max -= len(r.Check.Output)
+		for _, previous := range r.Check.Hooks {
+			max -= len(previous.Output)
+		}
+		if max < 0 {
+			max = 0
+		}
+	}
+
+	hr := runHook(name, hook, max)
+	r.Check.Hooks = append(r.Check.Hooks, hr)
+	return hr, true
+}
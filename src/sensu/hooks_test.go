@@ -0,0 +1,77 @@
+package sensu
+
+import (
+	"plugins"
+	"strings"
+	"testing"
+)
+
+func Test_HookFor(t *testing.T) {
+	hooks := map[string]plugins.Hook{
+		"critical": {Command: "ps aux"},
+		"non-zero": {Command: "df -h"},
+	}
+
+	var tests = []struct {
+		status   plugins.Status
+		expected string
+	}{
+		{plugins.CRITICAL, "critical"},
+		{plugins.WARNING, "non-zero"},
+		{plugins.UNKNOWN, "non-zero"},
+		{plugins.OK, ""},
+	}
+
+	for _, test := range tests {
+		name, _, ok := hookFor(hooks, test.status)
+		if test.expected != name || ("" != test.expected) != ok {
+			t.Errorf("expected the %q hook for %s, got %q", test.expected, test.status.ToString(), name)
+		}
+	}
+}
+
+func Test_RunHook(t *testing.T) {
+	hr := runHook("critical", plugins.Hook{Command: "echo diagnostics | tr a-z A-Z; exit 3"}, -1)
+	if "DIAGNOSTICS\n" != hr.Output || 3 != hr.Status || "critical" != hr.Name {
+		t.Errorf("unexpected hook result: %+v", hr)
+	}
+
+	hr = runHook("critical", plugins.Hook{Command: "sleep 5", Timeout: 1}, -1)
+	if -1 != hr.Status || !strings.Contains(hr.Output, "timed out") {
+		t.Errorf("expected the hook to time out: %+v", hr)
+	}
+}
+
+func Test_ResultRunHooks(t *testing.T) {
+	result := NewResult(ClientConfig{Name: "test"}, "check_procs")
+	hooks := map[string]plugins.Hook{"ok": {Command: "echo fine"}}
+
+	if _, ok := result.runHooks(hooks, plugins.CRITICAL); ok || 0 != len(result.Check.Hooks) {
+		t.Error("expected no hook to run for critical")
+	}
+	if _, ok := result.runHooks(hooks, plugins.OK); !ok || 1 != len(result.Check.Hooks) {
+		t.Fatal("expected the ok hook to run")
+	}
+	if "fine\n" != result.Check.Hooks[0].Output {
+		t.Errorf("unexpected hook output: %q", result.Check.Hooks[0].Output)
+	}
+}
+
+func Test_RunHookOutputLimit(t *testing.T) {
+	hr := runHook("critical", plugins.Hook{Command: "head -c 100000 /dev/zero | tr '\\0' x"}, 64)
+	if 64 != len(hr.Output) || !strings.HasSuffix(hr.Output, "\n[output truncated, 100000 bytes in all]") {
+		t.Errorf("expected the hook output cut to 64 bytes, got %d: %q", len(hr.Output), hr.Output)
+	}
+
+	// the hook shares the limit with the check output
+	config := newCheckConfig(map[string]interface{}{"command": "check_procs", "type": "check", "max_output_size": float64(100)})
+	result := NewResult(ClientConfig{Name: "test"}, "check_procs")
+	result.SetCheckConfig(config)
+	gathered := new(plugins.Result)
+	gathered.Add("3 processes")
+	result.SetGathered("CheckProcs CRITICAL", config, gathered)
+	result.runHooks(map[string]plugins.Hook{"critical": {Command: "ps aux; ps aux"}}, plugins.CRITICAL)
+	if size := len(result.Output()) + len(result.Check.Hooks[0].Output); size > 99 {
+		t.Errorf("expected the check and hook output to fit in 100 bytes with the newline, got %d", size)
+	}
+}
@@ -0,0 +1,301 @@
+package sensu
+
+import (
+	"fmt"
+	"plugins"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// what we know about a scheduled job between its runs
+type jobState struct {
+	lock sync.Mutex
+
+	subdued  int   // runs skipped because the check was subdued
+	skipped  int   // runs skipped because the previous run was still going
+	late     int   // runs that started late, waiting on a previous run or a free slot
+	failures int   // runs in a row that failed to gather
+	lastErr  error // why the last run failed
+
+	status    plugins.Status // how the last run went, for the checks that depend on this one
+	hasStatus bool           // false until the job has run
+	dependent int            // runs skipped because a dependency was failing
+	reported  int            // dependency reports in a row, kept out of the history
+
+	history     []plugins.Status // the statuses of the last 21 runs, oldest first
+	flapping    bool
+	occurrences int // runs in a row with the current status
+	held        int // failures not sent because they had not occurred often enough
+
+	published       bool              // whether or not a result has been sent yet
+	publishedStatus plugins.Status    // the status of the last result sent
+	publishedValues map[string]string // the metrics in the last result sent, for the delta policy
+	sincePublished  int               // runs since a result was last sent
+	suppressed      int               // results not sent because nothing had changed
+
+	paused  bool      // scheduled runs are skipped while paused
+	lastRun time.Time // when the job last started
+	nextRun time.Time // when the job is next due
+
+	trigger chan bool // asks the scheduler for a run right now
+}
+
+// a snapshot of a scheduled job, as shown by `sensu-client ctl list`
+type JobInfo struct {
+	Name       string    `json:"name"`
+	Command    string    `json:"command"`
+	Schedule   string    `json:"schedule"`
+	Status     string    `json:"status"`
+	Flapping   bool      `json:"flapping"`
+	Paused     bool      `json:"paused"`
+	LastRun    time.Time `json:"last_run"`
+	NextRun    time.Time `json:"next_run"`
+	Failures   int       `json:"failures"`
+	LastError  string    `json:"last_error,omitempty"`
+	Subdued    int       `json:"subdued"`
+	Skipped    int       `json:"skipped"`
+	Late       int       `json:"late"`
+	Dependent  int       `json:"dependent"`
+	Held       int       `json:"held"`
+	Suppressed int       `json:"suppressed"`
+}
+
+// gets the state for a job, creating it the first time we see the job.
+// state lives for as long as the processor, so it survives a reconnect
+func (p *PluginProcessor) jobState(name string) *jobState {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+
+	state, ok := p.state[name]
+	if !ok {
+		state = new(jobState)
+		state.trigger = make(chan bool, 1)
+		p.state[name] = state
+	}
+	return state
+}
+
+// finds the state for a job without creating it
+func (p *PluginProcessor) findJobState(name string) (*jobState, bool) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	state, ok := p.state[name]
+	return state, ok
+}
+
+// records a failed run, returning how many runs in a row have failed
+func (s *jobState) fail(err error) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures++
+	s.lastErr = err
+	return s.failures
+}
+
+// records a good run, returning how many runs had failed before it
+func (s *jobState) recover() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	failures := s.failures
+	s.failures = 0
+	s.lastErr = nil
+	return failures
+}
+
+func (s *jobState) countSubdued() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subdued++
+	return s.subdued
+}
+
+func (s *jobState) countSkipped() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.skipped++
+	return s.skipped
+}
+
+func (s *jobState) countLate() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.late++
+	return s.late
+}
+
+func (s *jobState) failureCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.failures
+}
+
+// the status of the last run, false when the job has not run yet
+func (s *jobState) lastStatus() (plugins.Status, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.status, s.hasStatus
+}
+
+// records the status of a run in the history. returns the history as sensu
+// publishes it, whether the check is flapping and how many runs in a row have
+// had this status
+func (s *jobState) record(status plugins.Status, low, high int) ([]string, bool, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.hasStatus && s.status == status {
+		s.occurrences++
+	} else {
+		s.occurrences = 1
+	}
+	s.status, s.hasStatus = status, true
+	s.reported = 0
+
+	s.history = append(s.history, status)
+	if len(s.history) > flapHistorySize {
+		s.history = s.history[len(s.history)-flapHistorySize:]
+	}
+	s.flapping = isFlapping(s.flapping, totalStateChange(s.history), low, high)
+
+	history := make([]string, len(s.history))
+	for i, past := range s.history {
+		history[i] = strconv.Itoa(past.ToInt())
+	}
+	return history, s.flapping, s.occurrences
+}
+
+// counts a report sent in place of a run while a dependency is failing. it is
+// not a status of the check's own, so the history, flapping and what the checks
+// that depend on this one see are left alone. returns the reports in a row
+func (s *jobState) recordDependencyReport() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reported++
+	return s.reported
+}
+
+func (s *jobState) countHeld() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.held++
+	return s.held
+}
+
+func (s *jobState) countDependent() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dependent++
+	return s.dependent
+}
+
+func (s *jobState) isPaused() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.paused
+}
+
+func (s *jobState) setPaused(paused bool) {
+	s.lock.Lock()
+	s.paused = paused
+	s.lock.Unlock()
+}
+
+func (s *jobState) setLastRun(t time.Time) {
+	s.lock.Lock()
+	s.lastRun = t
+	s.lock.Unlock()
+}
+
+func (s *jobState) setNextRun(t time.Time) {
+	s.lock.Lock()
+	s.nextRun = t
+	s.lock.Unlock()
+}
+
+// lists our scheduled jobs, sorted by name
+func (p *PluginProcessor) Jobs() []JobInfo {
+	p.jobsLock.RLock()
+	names := make([]string, 0, len(p.jobsConfig))
+	for name := range p.jobs {
+		names = append(names, name)
+	}
+	p.jobsLock.RUnlock()
+	sort.Strings(names)
+
+	jobs := make([]JobInfo, 0, len(names))
+	for _, name := range names {
+		config, _, _ := p.jobConfig(name)
+		info := JobInfo{Name: name, Command: config.Command}
+		if "" != config.Cron {
+			info.Schedule = config.Cron
+		} else {
+			info.Schedule = fmt.Sprintf("every %ds", config.Interval)
+		}
+
+		state := p.jobState(name)
+		state.lock.Lock()
+		if state.hasStatus {
+			info.Status = state.status.ToString()
+		}
+		info.Flapping = state.flapping
+		info.Paused = state.paused
+		info.LastRun = state.lastRun
+		info.NextRun = state.nextRun
+		info.Failures = state.failures
+		if nil != state.lastErr {
+			info.LastError = state.lastErr.Error()
+		}
+		info.Subdued = state.subdued
+		info.Skipped = state.skipped
+		info.Late = state.late
+		info.Dependent = state.dependent
+		info.Held = state.held
+		info.Suppressed = state.suppressed
+		state.lock.Unlock()
+
+		jobs = append(jobs, info)
+	}
+	return jobs
+}
+
+// runs a job straight away, outside of its schedule. paused jobs can still be run this way
+func (p *PluginProcessor) RunJob(name string) error {
+	if !p.hasJob(name) {
+		return fmt.Errorf("No such check: %s", name)
+	}
+
+	select {
+	case p.jobState(name).trigger <- true:
+		return nil
+	default:
+		return fmt.Errorf("A run of %s is already waiting", name)
+	}
+}
+
+// stops a job's scheduled runs until it is resumed
+func (p *PluginProcessor) PauseJob(name string) error {
+	if !p.hasJob(name) {
+		return fmt.Errorf("No such check: %s", name)
+	}
+	p.jobState(name).setPaused(true)
+	p.logger.Printf("Pausing: %s", name)
+	return nil
+}
+
+func (p *PluginProcessor) ResumeJob(name string) error {
+	if !p.hasJob(name) {
+		return fmt.Errorf("No such check: %s", name)
+	}
+	p.jobState(name).setPaused(false)
+	p.logger.Printf("Resuming: %s", name)
+	return nil
+}
+
+func (p *PluginProcessor) hasJob(name string) bool {
+	p.jobsLock.RLock()
+	defer p.jobsLock.RUnlock()
+	_, ok := p.jobs[name]
+	return ok
+}
@@ -0,0 +1,228 @@
+package sensu
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"plugins"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the ways a metric result can be written out, chosen by the check's output_format
+const (
+	formatGraphite = "graphite" // name value timestamp
+	formatInflux   = "influx"   // influx line protocol
+	formatOpenTSDB = "opentsdb" // opentsdb telnet put
+	formatJSON     = "json"     // a json array of points
+)
+
+// a single metric value, with the graphite name broken up into a measurement,
+// field and tags by the check's output_template
+type metricPoint struct {
+	Name        string // the full graphite name
+	Measurement string
+	Field       string
+	Tags        map[string]string
+	Value       string
+	Time        uint
+}
+
+type metricFormatter func(points []metricPoint) string
+
+var metricFormatters = map[string]metricFormatter{
+	formatGraphite: formatGraphitePoints,
+	formatInflux:   formatInfluxPoints,
+	formatOpenTSDB: formatOpenTSDBPoints,
+	formatJSON:     formatJSONPoints,
+}
+
+// turns the rows of a metric into points. typed metrics and wrapped rows of
+// "name value" get our prefix and the time they were gathered, unwrapped rows
+// are whole "name value timestamp" lines from an external metric
+func metricPoints(rows []plugins.ResultStat, prefix string, wrapped bool, started uint) []metricPoint {
+	var points []metricPoint
+	for _, row := range rows {
+		t := started
+		if row.TimeIsSet {
+			t = uint(row.Time.Unix())
+		}
+
+		if row.IsMetric() {
+			points = append(points, metricPoint{Name: prefix + "." + row.Name, Value: plugins.FormatValue(row.Value), Tags: row.Tags, Time: t})
+			continue
+		}
+
+		for _, line := range strings.Split(row.Output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || len(fields) > 3 {
+				continue
+			}
+
+			point := metricPoint{Name: fields[0], Value: fields[1], Time: t}
+			if wrapped {
+				point.Name = prefix + "." + point.Name
+			}
+			if 3 == len(fields) {
+				if ts, err := strconv.ParseUint(fields[2], 10, 64); nil == err {
+					point.Time = uint(ts)
+				}
+			}
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// a graphite to tags template in the style of influxdb's graphite input, one
+// token for each part of the name. "measurement" and "field" parts are joined
+// with dots, a trailing * takes the rest of the name, an empty token skips a
+// part and anything else is a tag. "host.host.measurement.field*" maps
+// stb.site.cpu.user to measurement cpu, field user and host=stb.site
+type metricTemplate []string
+
+func parseMetricTemplate(template string) metricTemplate {
+	if "" == template {
+		return nil
+	}
+	return metricTemplate(strings.Split(template, "."))
+}
+
+// fills in the measurement, field and tags of a point from its name. without a
+// template the whole name is the measurement. tags the metric was given win
+// over those from the template, and every point is tagged with the client it
+// came from unless something else says otherwise
+func (t metricTemplate) apply(point *metricPoint, host string) {
+	given := point.Tags
+	point.Measurement = point.Name
+	point.Field = "value"
+	point.Tags = make(map[string]string)
+
+	var measurement, field []string
+	parts := strings.Split(point.Name, ".")
+	for i, token := range t {
+		if i >= len(parts) {
+			break
+		}
+		switch token {
+		case "":
+		case "measurement":
+			measurement = append(measurement, parts[i])
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field":
+			field = append(field, parts[i])
+		case "field*":
+			field = append(field, parts[i:]...)
+		default:
+			if tag, ok := point.Tags[token]; ok {
+				point.Tags[token] = tag + "." + parts[i]
+			} else {
+				point.Tags[token] = parts[i]
+			}
+		}
+	}
+
+	if len(measurement) > 0 {
+		point.Measurement = strings.Join(measurement, ".")
+	}
+	if len(field) > 0 {
+		point.Field = strings.Join(field, ".")
+	}
+	for key, value := range given {
+		point.Tags[key] = value
+	}
+	if _, ok := point.Tags["host"]; !ok && "" != host {
+		point.Tags["host"] = host
+	}
+}
+
+// the measurement and field together, for formats without fields
+func (point metricPoint) metricName() string {
+	if "value" == point.Field {
+		return point.Measurement
+	}
+	return point.Measurement + "." + point.Field
+}
+
+func (point metricPoint) sortedTags() []string {
+	keys := make([]string, 0, len(point.Tags))
+	for key := range point.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return nil == err
+}
+
+func formatGraphitePoints(points []metricPoint) string {
+	var output string
+	for _, point := range points {
+		output += fmt.Sprintf("%s %s %d\n", point.Name, point.Value, point.Time)
+	}
+	return output
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func formatInfluxPoints(points []metricPoint) string {
+	var output string
+	for _, point := range points {
+		line := strings.NewReplacer(",", `\,`, " ", `\ `).Replace(point.Measurement)
+		for _, key := range point.sortedTags() {
+			line += "," + influxEscaper.Replace(key) + "=" + influxEscaper.Replace(point.Tags[key])
+		}
+
+		value := point.Value
+		if !isNumber(value) {
+			value = strconv.Quote(value)
+		}
+		output += fmt.Sprintf("%s %s=%s %d\n", line, influxEscaper.Replace(point.Field), value, uint64(point.Time)*1e9)
+	}
+	return output
+}
+
+// opentsdb only takes numbers, anything else is left out
+func formatOpenTSDBPoints(points []metricPoint) string {
+	var output string
+	for _, point := range points {
+		if !isNumber(point.Value) {
+			continue
+		}
+		line := fmt.Sprintf("put %s %d %s", point.metricName(), point.Time, point.Value)
+		for _, key := range point.sortedTags() {
+			line += " " + key + "=" + strings.Replace(point.Tags[key], " ", "_", -1)
+		}
+		output += line + "\n"
+	}
+	return output
+}
+
+type jsonPoint struct {
+	Name      string            `json:"name"`
+	Value     interface{}       `json:"value"`
+	Timestamp uint              `json:"timestamp"`
+	Tags      map[string]string `json:"tags,omitempty"`
+}
+
+// json has no NaN or infinities, so like any other value that is not a plain
+// number they go as strings. each point is encoded on its own, so one that
+// cannot be never takes the rest with it
+func formatJSONPoints(points []metricPoint) string {
+	encoded := make([]string, 0, len(points))
+	for _, point := range points {
+		var value interface{} = point.Value
+		if f, err := strconv.ParseFloat(point.Value, 64); nil == err && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			value = f
+		}
+		if output, err := json.Marshal(jsonPoint{Name: point.metricName(), Value: value, Timestamp: point.Time, Tags: point.Tags}); nil == err {
+			encoded = append(encoded, string(output))
+		}
+	}
+	return "[" + strings.Join(encoded, ",") + "]\n"
+}
@@ -0,0 +1,131 @@
+package sensu
+
+import (
+	"plugins"
+	"testing"
+	"time"
+)
+
+func Test_MetricTemplate(t *testing.T) {
+	var tests = []struct {
+		template    string
+		name        string
+		measurement string
+		field       string
+		tags        map[string]string
+	}{
+		{"", "stb.site.cpu.user", "stb.site.cpu.user", "value", map[string]string{"host": "client"}},
+		{"host.host.measurement.field*", "stb.site.cpu.cpu0.user", "cpu", "cpu0.user", map[string]string{"host": "stb.site"}},
+		{".site.measurement*", "stb.site.load_avg.one", "load_avg.one", "value", map[string]string{"site": "site", "host": "client"}},
+		{"host.measurement.interface.field", "box.interface.eth0.rx_bytes", "interface", "rx_bytes", map[string]string{"host": "box", "interface": "eth0"}},
+	}
+
+	for _, test := range tests {
+		point := metricPoint{Name: test.name}
+		parseMetricTemplate(test.template).apply(&point, "client")
+		if test.measurement != point.Measurement || test.field != point.Field {
+			t.Errorf("%q: expected %s %s, got %s %s", test.template, test.measurement, test.field, point.Measurement, point.Field)
+		}
+		if len(test.tags) != len(point.Tags) {
+			t.Errorf("%q: expected tags %v, got %v", test.template, test.tags, point.Tags)
+		}
+		for key, value := range test.tags {
+			if value != point.Tags[key] {
+				t.Errorf("%q: expected tags %v, got %v", test.template, test.tags, point.Tags)
+			}
+		}
+	}
+}
+
+func Test_MetricFormatters(t *testing.T) {
+	points := []metricPoint{
+		{Name: "stb.site.cpu.user", Value: "12", Time: 1400000000},
+		{Name: "stb.site.display.hdmi", Value: "on air", Time: 1400000000},
+	}
+	template := parseMetricTemplate("host.host.measurement.field")
+	for i := range points {
+		template.apply(&points[i], "stb.site.loc")
+	}
+
+	var tests = []struct {
+		format   string
+		expected string
+	}{
+		{formatGraphite, "stb.site.cpu.user 12 1400000000\nstb.site.display.hdmi on air 1400000000\n"},
+		{formatInflux, "cpu,host=stb.site user=12 1400000000000000000\ndisplay,host=stb.site hdmi=\"on air\" 1400000000000000000\n"},
+		{formatOpenTSDB, "put cpu.user 1400000000 12 host=stb.site\n"},
+		{formatJSON, `[{"name":"cpu.user","value":12,"timestamp":1400000000,"tags":{"host":"stb.site"}},{"name":"display.hdmi","value":"on air","timestamp":1400000000,"tags":{"host":"stb.site"}}]` + "\n"},
+	}
+	for _, test := range tests {
+		if output := metricFormatters[test.format](points); test.expected != output {
+			t.Errorf("%s: expected %q, got %q", test.format, test.expected, output)
+		}
+	}
+}
+
+func Test_JSONPointsNotFinite(t *testing.T) {
+	points := []metricPoint{
+		{Name: "cpu.user", Measurement: "cpu", Field: "user", Value: "NaN", Time: 1400000000},
+		{Name: "cpu.system", Measurement: "cpu", Field: "system", Value: "+Inf", Time: 1400000000},
+		{Name: "cpu.idle", Measurement: "cpu", Field: "idle", Value: "88", Time: 1400000000},
+	}
+	expected := `[{"name":"cpu.user","value":"NaN","timestamp":1400000000},{"name":"cpu.system","value":"+Inf","timestamp":1400000000},{"name":"cpu.idle","value":88,"timestamp":1400000000}]` + "\n"
+	if output := formatJSONPoints(points); expected != output {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func Test_MetricOutputFormat(t *testing.T) {
+	rows := []plugins.ResultStat{{Output: "load_avg.one 0.5"}}
+
+	result := NewResult(ClientConfig{Name: "stb.site.loc"}, "load_metrics")
+	result.SetCheckConfig(plugins.PluginConfig{OutputFormat: formatInflux, OutputTemplate: "host.host.measurement.field"})
+	result.Check.Executed = 1400000000
+	result.SetOutput(rows)
+	if "load_avg,host=stb.site one=0.5 1400000000000000000\n" != result.Check.Output {
+		t.Errorf("expected influx line protocol, got %q", result.Check.Output)
+	}
+
+	// external metrics bring their own names and timestamps
+	external := NewResult(ClientConfig{Name: "stb.site.loc"}, "external")
+	external.SetCheckConfig(plugins.PluginConfig{OutputFormat: formatOpenTSDB})
+	external.SetWrapOutput(false)
+	external.SetOutput([]plugins.ResultStat{{Output: "app.requests 42 1400000001\napp.errors 1 1400000001\n", Time: time.Now()}})
+	if "put app.requests 1400000001 42 host=stb.site.loc\nput app.errors 1400000001 1 host=stb.site.loc\n" != external.Check.Output {
+		t.Errorf("expected opentsdb puts, got %q", external.Check.Output)
+	}
+
+	// the default stays as it always was
+	plain := NewResult(ClientConfig{Name: "stb.site.loc"}, "load_metrics")
+	plain.Check.Executed = 1400000000
+	plain.SetOutput(rows)
+	if "stb.site.load_avg.one 0.5 1400000000\n" != plain.Check.Output {
+		t.Errorf("expected graphite, got %q", plain.Check.Output)
+	}
+}
+
+func Test_TypedMetricOutput(t *testing.T) {
+	gathered := new(plugins.Result)
+	gathered.AddMetric("interface.eth0.rx_bytes", 1048576, map[string]string{"interface": "eth0"})
+	gathered.AddMetric("load_avg.one", 0.5, nil)
+
+	plain := NewResult(ClientConfig{Name: "stb.site.loc"}, "metrics")
+	plain.Check.Executed = 1400000000
+	plain.SetOutput(gathered.Output())
+	if "stb.site.interface.eth0.rx_bytes 1048576 1400000000\nstb.site.load_avg.one 0.5 1400000000\n" != plain.Check.Output {
+		t.Errorf("expected the same graphite lines as before, got %q", plain.Check.Output)
+	}
+
+	influx := NewResult(ClientConfig{Name: "stb.site.loc"}, "metrics")
+	influx.SetCheckConfig(plugins.PluginConfig{OutputFormat: formatInflux, OutputTemplate: "host.host.measurement"})
+	influx.Check.Executed = 1400000000
+	influx.SetOutput(gathered.Output())
+	expected := "interface,host=stb.site,interface=eth0 value=1048576 1400000000000000000\nload_avg,host=stb.site value=0.5 1400000000000000000\n"
+	if expected != influx.Check.Output {
+		t.Errorf("expected the metric's tags alongside the template's, got %q", influx.Check.Output)
+	}
+
+	if values := metricValues(gathered.Output()); "0.5" != values["load_avg.one"] {
+		t.Errorf("expected typed values to be compared, got %v", values)
+	}
+}
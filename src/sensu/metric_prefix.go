@@ -0,0 +1,139 @@
+package sensu
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"plugins"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// the name our metrics start with, from the client or check metric_prefix.
+// the default keeps the original stb.<location-name> naming
+const defaultMetricPrefix = "{{.Client.Name | shortname}}"
+
+var metricPrefixFuncs = template.FuncMap{
+	"reverse":   reverseName,
+	"shortname": shortName,
+}
+
+// what a metric_prefix template can see: every client attribute, by its name
+// in the config as well as .Client.Name and .Client.Address, and the check name
+type metricPrefixData struct {
+	Client map[string]interface{}
+	Check  string
+}
+
+// host name schema is stb.<location-name>.loc.swiftnetworks.com.au, everything
+// else is known by the first part of its name
+func shortName(name string) string {
+	bits := strings.Split(name, ".")
+	if "stb" == bits[0] && len(bits) > 1 {
+		return fmt.Sprintf("%s.%s", bits[0], bits[1])
+	}
+	return bits[0]
+}
+
+// www.example.com becomes com.example.www
+func reverseName(name string) string {
+	bits := strings.Split(name, ".")
+	for i, j := 0, len(bits)-1; i < j; i, j = i+1, j-1 {
+		bits[i], bits[j] = bits[j], bits[i]
+	}
+	return strings.Join(bits, ".")
+}
+
+// a parsed metric_prefix, or why it would not parse, along with the checks it
+// has been reported broken for
+type parsedMetricPrefix struct {
+	t        *template.Template
+	err      error
+	reported map[string]bool
+}
+
+// the metric_prefix templates a processor has seen, each parsed the first time
+// it is seen. a new processor, as on a reload, starts again
+type metricPrefixes struct {
+	lock   sync.Mutex
+	parsed map[string]*parsedMetricPrefix
+}
+
+func newMetricPrefixes() *metricPrefixes {
+	return &metricPrefixes{parsed: make(map[string]*parsedMetricPrefix)}
+}
+
+func (m *metricPrefixes) parse(prefixTemplate string) *parsedMetricPrefix {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	parsed, ok := m.parsed[prefixTemplate]
+	if !ok {
+		parsed = &parsedMetricPrefix{reported: make(map[string]bool)}
+		parsed.t, parsed.err = template.New("metric_prefix").Funcs(metricPrefixFuncs).Option("missingkey=error").Parse(prefixTemplate)
+		m.parsed[prefixTemplate] = parsed
+	}
+	return parsed
+}
+
+// whether an error with the template still has to be logged for a check, only the first time
+func (m *metricPrefixes) report(parsed *parsedMetricPrefix, check string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	first := !parsed.reported[check]
+	parsed.reported[check] = true
+	return first
+}
+
+func (m *metricPrefixes) expand(prefixTemplate string, data metricPrefixData) (string, *parsedMetricPrefix, error) {
+	parsed := m.parse(prefixTemplate)
+	if nil != parsed.err {
+		return "", parsed, parsed.err
+	}
+
+	var prefix bytes.Buffer
+	if err := parsed.t.Execute(&prefix, data); nil != err {
+		return "", parsed, err
+	}
+	return prefix.String(), parsed, nil
+}
+
+// works out the metric prefix for a check, the check's own template winning
+// over the client's. a template that does not work falls back to the default,
+// saying why the first time
+func (m *metricPrefixes) metricPrefix(config *Config, checkConfig plugins.PluginConfig, logger *log.Logger) string {
+	prefixTemplate := checkConfig.MetricPrefix
+	if "" == prefixTemplate {
+		prefixTemplate = config.Client.MetricPrefix
+	}
+	if "" == prefixTemplate {
+		prefixTemplate = defaultMetricPrefix
+	}
+
+	data := metricPrefixData{Client: clientAttributes(config), Check: checkConfig.Name}
+	prefix, parsed, err := m.expand(prefixTemplate, data)
+	if nil == err {
+		return prefix
+	}
+	if m.report(parsed, checkConfig.Name) {
+		logger.Printf("Invalid metric_prefix %q for %s, using the default: %v", prefixTemplate, checkConfig.Name, err)
+	}
+
+	prefix, _, _ = m.expand(defaultMetricPrefix, data)
+	return prefix
+}
+
+func clientAttributes(config *Config) map[string]interface{} {
+	attributes := make(map[string]interface{})
+	if nil != config.Data() {
+		if client, err := config.Data().Get("client").Map(); nil == err {
+			for key, value := range client {
+				attributes[key] = value
+			}
+		}
+	}
+	attributes["Name"] = config.Client.Name
+	attributes["Address"] = config.Client.Address
+	return attributes
+}
@@ -0,0 +1,70 @@
+package sensu
+
+import (
+	"bytes"
+	"github.com/bitly/go-simplejson"
+	"io/ioutil"
+	"log"
+	"plugins"
+	"strings"
+	"testing"
+)
+
+func Test_MetricPrefix(t *testing.T) {
+	var tests = []struct {
+		name         string
+		clientPrefix string
+		checkPrefix  string
+		expected     string
+	}{
+		{"stb.bondi.loc.example.com", "", "", "stb.bondi"},
+		{"web1.example.com", "", "", "web1"},
+		{"stb", "", "", "stb"},
+		{"web1.example.com", "{{.Client.Name | reverse}}.{{.Check}}", "", "com.example.web1.cpu_metrics"},
+		{"web1.example.com", "devices.{{.Client.site}}", "", "devices.bondi"},
+		{"web1.example.com", "devices.{{.Client.site}}", "{{.Client.Name | shortname}}.{{.Check}}", "web1.cpu_metrics"},
+		// a template that does not work falls back to the default
+		{"web1.example.com", "{{.Client.missing}}", "", "web1"},
+		{"web1.example.com", "{{.Client.Name", "", "web1"},
+	}
+
+	prefixes := newMetricPrefixes()
+	for _, test := range tests {
+		config := &Config{Client: ClientConfig{Name: test.name, MetricPrefix: test.clientPrefix}}
+		config.rawData, _ = simplejson.NewJson([]byte(`{"client":{"name":"` + test.name + `","site":"bondi"}}`))
+		checkConfig := plugins.PluginConfig{Name: "cpu_metrics", MetricPrefix: test.checkPrefix}
+
+		if prefix := prefixes.metricPrefix(config, checkConfig, log.New(ioutil.Discard, "", 0)); test.expected != prefix {
+			t.Errorf("%s %q %q: expected %s, got %s", test.name, test.clientPrefix, test.checkPrefix, test.expected, prefix)
+		}
+	}
+}
+
+func Test_MetricPrefixParsedOnce(t *testing.T) {
+	prefixes := newMetricPrefixes()
+	if prefixes.parse("{{.Check}}.parsed") != prefixes.parse("{{.Check}}.parsed") {
+		t.Error("expected a template to be parsed once and kept")
+	}
+
+	var logged bytes.Buffer
+	logger := log.New(&logged, "", 0)
+	config := &Config{Client: ClientConfig{Name: "web1.example.com"}}
+	checkConfig := plugins.PluginConfig{Name: "cpu_metrics", MetricPrefix: "{{.Check"}
+
+	for i := 0; i < 3; i++ {
+		if prefix := prefixes.metricPrefix(config, checkConfig, logger); "web1" != prefix {
+			t.Errorf("expected the default prefix, got %s", prefix)
+		}
+	}
+	if 1 != strings.Count(logged.String(), "Invalid metric_prefix") {
+		t.Errorf("expected the broken template to be reported once, got %q", logged.String())
+	}
+
+	// every check using it hears about it, and so does the next processor
+	checkConfig.Name = "disk_metrics"
+	prefixes.metricPrefix(config, checkConfig, logger)
+	newMetricPrefixes().metricPrefix(config, checkConfig, logger)
+	if 3 != strings.Count(logged.String(), "Invalid metric_prefix") {
+		t.Errorf("expected the broken template to be reported for each check and processor, got %q", logged.String())
+	}
+}
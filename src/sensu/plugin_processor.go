@@ -1,45 +1,73 @@
 package sensu
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"github.com/bitly/go-simplejson"
+	"github.com/streadway/amqp"
 	"io"
 	"log"
-	"os"
+	"math"
 	"plugins"
 	"plugins/checks"
 	"plugins/metrics"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// the most seconds a failing job waits before it is tried again
+const jobRetryIntervalMax = 600
+
 type PluginProcessor struct {
 	q                            MessageQueuer
 	config                       *Config
 	jobs                         map[string]plugins.SensuPluginInterface
 	jobsConfig                   map[string]plugins.PluginConfig
+	schedules                    map[string]schedule
+	jobsLock                     sync.RWMutex // guards jobs, jobsConfig and schedules
+	state                        map[string]*jobState
+	stateLock                    sync.Mutex
+	slots                        chan bool      // limits how many jobs run at once, nil when there is no limit
+	inFlight                     sync.WaitGroup // scheduled runs that have been started and not finished
 	close                        chan bool
-	publishResultsChan           chan bool
-	saveResultsChan              chan bool
-	results                      chan ResultInterface
+	publishResultsChan           chan bool    // true to save results instead, false to stop
+	saveResultsChan              chan bool    // true to publish results again, false to stop
+	resultsDone                  chan bool    // closed once handleResults has stopped, nil when it is not running
+	saving                       bool         // results are going to the stat store until RabbitMQ is back
+	runLock                      sync.Mutex   // Start and Stop are called from different goroutines
+	results                      *resultQueue // results waiting to be published
+	retry                        *resultQueue // results that failed to publish
 	logger                       *log.Logger
 	statsCollecting              bool // whether or not to set off more jobs
 	stopCollectingOnNoConnection bool // whether or not to stop collecting stats when the connection to RabbitMQ drops
 	statStore                    string
-    started                      bool
+	store                        *statStore          // where results wait while we cannot reach RabbitMQ
+	exporter                     *PrometheusExporter // also gets the metrics we gather, nil when not serving them
+	carbon                       *carbonSink         // where metrics routed to carbon go, nil when there is no carbon server
+	carbonLock                   sync.RWMutex        // guards carbon, held while sending so nothing is sent once it has stopped
+	counters                     *clientCounters     // what we count about ourselves, shared with the subscriber
+	prefixes                     *metricPrefixes
+	started                      bool
 }
 
 // used to create a new processor instance.
 func NewPluginProcessor(w io.Writer, statStore string) *PluginProcessor {
 	proc := new(PluginProcessor)
 	proc.jobsConfig = make(map[string]plugins.PluginConfig)
-	proc.results = make(chan ResultInterface, 600) // queue of 600 buffered results
+	proc.schedules = make(map[string]schedule)
+	proc.state = make(map[string]*jobState)
+	proc.results = newResultQueue(defaultResultQueueSize, overflowDropOldest)
+	proc.retry = newResultQueue(defaultResultQueueSize, overflowDropOldest)
 	proc.publishResultsChan = make(chan bool)
 	proc.saveResultsChan = make(chan bool)
 	proc.logger = log.New(w, "Plugin: ", log.LstdFlags)
+	proc.counters = new(clientCounters)
+	proc.prefixes = newMetricPrefixes()
 	proc.statStore = statStore
 	if "" == statStore {
 		proc.stopCollectingOnNoConnection = true
@@ -64,22 +92,9 @@ func newCheckConfig(json interface{}) plugins.PluginConfig {
 		conf.Args = strings.Split(conf.Command, " ")
 	}
 
-	if handlers, ok := converted["handlers"]; ok {
-		conf.Handlers, _ = handlers.([]string)
-	}
+	configDecode(converted, "handlers", &conf.Handlers)
 
-	conf.Interval = 15 // default 15 second interval
-	if interval, ok := converted["interval"]; ok {
-		switch t := interval.(type) {
-		default:
-			i, err := strconv.ParseInt(fmt.Sprintf("%s", t), 10, 64)
-			if nil == err {
-				conf.Interval = time.Duration(i)
-			}
-		case int8, int16, int, int32, int64, uint8, uint16, uint, uint32, uint64:
-			conf.Interval = time.Duration(interval.(int64))
-		}
-	}
+	conf.Interval = time.Duration(configInt(converted, "interval", 15)) // default 15 second interval
 
 	conf.Standalone = true
 	if standalone, ok := converted["standalone"]; ok {
@@ -90,9 +105,137 @@ func newCheckConfig(json interface{}) plugins.PluginConfig {
 		conf.Type, _ = conf_type.(string)
 	}
 
+	if cron, ok := converted["cron"]; ok {
+		conf.Cron, _ = cron.(string)
+	}
+
+	if timezone, ok := converted["timezone"]; ok {
+		conf.Timezone, _ = timezone.(string)
+	}
+
+	conf.BackoffMax = time.Duration(configInt(converted, "backoff_max", 0))
+
+	if overlap, ok := converted["overlap"]; ok {
+		conf.Overlap, _ = overlap.(string)
+	}
+
+	conf.Splay = configBool(converted, "splay", true)
+	conf.SplayCoverage = int(configInt(converted, "splay_coverage", 0))
+
+	configDecode(converted, "subdue", &conf.Subdue)
+
+	configDecode(converted, "dependencies", &conf.Dependencies)
+	if action, ok := converted["dependency_action"]; ok {
+		conf.DependencyAction, _ = action.(string)
+	}
+
+	conf.LowFlapThreshold = int(configInt(converted, "low_flap_threshold", 0))
+	conf.HighFlapThreshold = int(configInt(converted, "high_flap_threshold", 0))
+	conf.Occurrences = int(configInt(converted, "occurrences", 1))
+
+	conf.Publish = publishAlways
+	if publish, ok := converted["publish"]; ok {
+		conf.Publish, _ = publish.(string)
+	}
+	conf.Heartbeat = int(configInt(converted, "heartbeat", defaultPublishHeartbeat))
+	configDecode(converted, "delta", &conf.Delta)
+
+	configDecode(converted, "hooks", &conf.Hooks)
+
+	if format, ok := converted["output_format"]; ok {
+		conf.OutputFormat, _ = format.(string)
+	}
+	if template, ok := converted["output_template"]; ok {
+		conf.OutputTemplate, _ = template.(string)
+	}
+	if prefix, ok := converted["metric_prefix"]; ok {
+		conf.MetricPrefix, _ = prefix.(string)
+	}
+	conf.MaxOutputSize = int(configInt(converted, "max_output_size", 0))
+	conf.Route = routeRabbitmq
+	if route, ok := converted["route"]; ok {
+		conf.Route, _ = route.(string)
+	}
+
+	conf.Custom = customAttributes(converted)
+
 	return conf
 }
 
+// the attributes plugins.PluginConfig knows about, by their json names
+var pluginConfigKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(plugins.PluginConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if "" != name && "-" != name {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// everything in a check config that is not one of ours, nil when there is nothing
+func customAttributes(converted map[string]interface{}) map[string]interface{} {
+	var custom map[string]interface{}
+	for key, value := range converted {
+		if pluginConfigKeys[key] {
+			continue
+		}
+		if nil == custom {
+			custom = make(map[string]interface{})
+		}
+		custom[key] = value
+	}
+	return custom
+}
+
+// reads a whole number from the check config. numbers can arrive as json.Number,
+// float64 or one of the int types depending on how the json was decoded
+func configInt(converted map[string]interface{}, key string, defaultValue int64) int64 {
+	value, ok := converted[key]
+	if !ok {
+		return defaultValue
+	}
+
+	switch t := value.(type) {
+	default:
+		i, err := strconv.ParseInt(fmt.Sprintf("%s", t), 10, 64)
+		if nil == err {
+			return i
+		}
+	case float64:
+		return int64(t)
+	case int:
+		return int64(t)
+	case int64:
+		return t
+	}
+	return defaultValue
+}
+
+// decodes a structured attribute from the check config into target
+func configDecode(converted map[string]interface{}, key string, target interface{}) error {
+	value, ok := converted[key]
+	if !ok {
+		return nil
+	}
+
+	raw, err := json.Marshal(value)
+	if nil != err {
+		return err
+	}
+	return json.Unmarshal(raw, target)
+}
+
+// reads a boolean from the check config
+func configBool(converted map[string]interface{}, key string, defaultValue bool) bool {
+	if value, ok := converted[key].(bool); ok {
+		return value
+	}
+	return defaultValue
+}
+
 // does the funky command line variable replacing stuff
 func commandReplace(command string, walkingConfigStart *simplejson.Json) string {
 	commandRe := regexp.MustCompile(":::(.*?):::")
@@ -147,10 +290,76 @@ func (p *PluginProcessor) AddJob(job plugins.SensuPluginInterface, checkConfig p
 
 	checkConfig.Command = commandReplace(checkConfig.Command, p.config.Data().Get("client"))
 
-	p.logger.Printf("Scheduling job: %s (%s) every %d seconds", name, checkConfig.Command, checkConfig.Interval)
+	sched, err := p.newSchedule(checkConfig)
+	if nil != err {
+		p.logger.Printf("Failed to schedule check: (%s) %s\n", name, err)
+		return
+	}
+
+	if "" != checkConfig.Cron {
+		p.logger.Printf("Scheduling job: %s (%s) at %q, next run at %s", name, checkConfig.Command, checkConfig.Cron, sched.Next(time.Now()).Format(time.RFC1123))
+	} else {
+		p.logger.Printf("Scheduling job: %s (%s) every %d seconds", name, checkConfig.Command, checkConfig.Interval)
+	}
 
+	p.jobsLock.Lock()
 	p.jobs[name] = job
 	p.jobsConfig[name] = checkConfig
+	p.schedules[name] = sched
+	p.jobsLock.Unlock()
+}
+
+// gets a job's config and schedule, safe to call while Init is running
+func (p *PluginProcessor) jobConfig(name string) (plugins.PluginConfig, schedule, bool) {
+	p.jobsLock.RLock()
+	defer p.jobsLock.RUnlock()
+
+	config, ok := p.jobsConfig[name]
+	return config, p.schedules[name], ok
+}
+
+// checks with a cron expression run at wall clock times, everything else every interval
+func (p *PluginProcessor) newSchedule(checkConfig plugins.PluginConfig) (schedule, error) {
+	if "" == checkConfig.Cron {
+		return intervalSchedule{checkConfig.Interval * time.Second}, nil
+	}
+
+	location, err := checkLocation(checkConfig, p.config.Client)
+	if nil != err {
+		return nil, err
+	}
+	return parseCron(checkConfig.Cron, location)
+}
+
+// the time zone cron expressions and subdue windows are in. the check can override the client
+func checkLocation(checkConfig plugins.PluginConfig, clientConfig ClientConfig) (*time.Location, error) {
+	name := checkConfig.Timezone
+	if "" == name {
+		name = clientConfig.Timezone
+	}
+	if "" == name {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// whether or not the check is in one of its subdue windows right now
+func checkSubdued(checkConfig plugins.PluginConfig, clientConfig ClientConfig) (bool, error) {
+	if nil == checkConfig.Subdue {
+		return false, nil
+	}
+
+	location, err := checkLocation(checkConfig, clientConfig)
+	if nil != err {
+		return false, err
+	}
+	return subdued(checkConfig.Subdue, time.Now().In(location))
+}
+
+// hands the metrics we gather to a Prometheus endpoint as well
+func (p *PluginProcessor) SetExporter(exporter *PrometheusExporter) {
+	p.exporter = exporter
+	p.counters.exporter = exporter
 }
 
 // called to set things up
@@ -164,17 +373,44 @@ func (p *PluginProcessor) Init(q MessageQueuer, config *Config) error {
 
 	p.q = q
 	p.config = config
+	if nil == p.store && "" != p.statStore {
+		// without RabbitMQ a replay would throw stored results away, so they wait for it
+		if config.Rabbitmq.Disabled {
+			p.logger.Printf("RabbitMQ is disabled, leaving the results in %s.wal until it is back", p.statStore)
+		} else if err := p.openStatStore(); nil != err {
+			p.logger.Printf("Unable to open the stat store, results will be lost while RabbitMQ is away: %v", err)
+		}
+	}
+	p.results.configure(config.Results.QueueSize, config.Results.Overflow)
+	p.retry.configure(config.Results.QueueSize, overflowSpill)
+	if nil != p.store {
+		p.results.setSpill(p.spillResult)
+		p.retry.setSpill(p.spillResult)
+	}
+	p.carbonLock.RLock()
+	noCarbon := nil == p.carbon
+	p.carbonLock.RUnlock()
+	if noCarbon && "" != config.Carbon.Host {
+		if err := p.openCarbon(); nil != err {
+			p.logger.Printf("Unable to send metrics to carbon, they will go to RabbitMQ: %v", err)
+		}
+	}
+	if nil == p.slots && config.Client.MaxConcurrentChecks > 0 {
+		p.slots = make(chan bool, config.Client.MaxConcurrentChecks)
+	}
 	p.close = make(chan bool, len(p.jobs)+1)
 	var check plugins.SensuPluginInterface
 
 	// load the checks we want to do
 	checks_config := p.config.Data().Get("checks").MustMap()
+	p.jobsLock.Lock()
 	p.jobs = make(map[string]plugins.SensuPluginInterface)
+	p.jobsLock.Unlock()
 
 	for check_type, checkConfigInterface := range checks_config {
 		checkConfig, ok := checkConfigInterface.(map[string]interface{})
 		if !ok {
-			p.logger.Printf("Failed to parse config: %", check_type)
+			p.logger.Printf("Failed to parse config: %s", check_type)
 			continue
 		}
 
@@ -183,6 +419,9 @@ func (p *PluginProcessor) Init(q MessageQueuer, config *Config) error {
 
 		config.Name = check_type
 
+		// a broken metric_prefix is reported now rather than on the first run
+		p.prefixes.metricPrefix(p.config, config, p.logger)
+
 		p.AddJob(check, config)
 	}
 
@@ -191,175 +430,464 @@ func (p *PluginProcessor) Init(q MessageQueuer, config *Config) error {
 
 // gets the Gather of checks/metrics going
 func (p *PluginProcessor) Start() {
-	go p.publishResults()
-    p.started = true
-	if p.statsCollecting {
+	p.runLock.Lock()
+	defer p.runLock.Unlock()
+
+	p.started = true
+	if nil == p.resultsDone {
+		p.resultsDone = make(chan bool)
+		go p.handleResults(p.resultsDone)
+	} else if p.saving {
 		// since Start() gets called when we have a good Rabbit connection - we can stop storing our results in a file
-		p.saveResultsChan <- false
+		p.saving = false
+		p.saveResultsChan <- true
+	}
+	if p.statsCollecting {
 		return
 	}
 
 	// we are collecting results now - used so that we do not fire up a second copy of the stats gathering
 	p.statsCollecting = true
 
-	clientConfig := p.config.Client
-
 	// start our result publisher thread
 	for job_name, job := range p.jobs {
-
 		// this is the main stats gathering function
-		go func(theJobName string, theJob plugins.SensuPluginInterface) {
-			config := p.jobsConfig[theJobName]
-
-			reset := make(chan bool)
-
-			timer := time.AfterFunc(0, func() {
-				p.logger.Printf("Gathering: %s", theJobName)
-				result := NewResult(clientConfig, theJobName)
-				result.SetCommand(config.Command)
-
-				plugin_result := new(plugins.Result)
-
-				err := theJob.Gather(plugin_result)
-				result.SetWrapOutput(!plugin_result.IsNoWrapOutput()) // for external checks
-				result.SetOutput(plugin_result.Output())
-				result.SetCheckStatus(theJob.GetStatus())
-
-				if nil != err {
-					// returned an error - we should stop this job from running
-					p.logger.Printf("Failed to gather stat: %s. %v", theJobName, err)
-					reset <- false
-					return
-				}
-
-				// add it to the processing queue
-				p.results <- result
-
-				reset <- true
-			})
-
-			defer timer.Stop()
-			for {
-				select {
-				case cont := <-reset:
-					if cont {
-						timer.Reset(config.Interval * time.Second)
-					} else {
-						timer.Stop()
-					}
-				case <-p.close: // shutting down stats gather message
-					return
-				}
-			}
-		}(job_name, job)
+		go p.scheduleJob(job_name, job)
 	}
 }
 
 // Puts a halt to all of our checks/metrics gathering
 func (p *PluginProcessor) Stop(force bool) {
+	p.runLock.Lock()
+	defer p.runLock.Unlock()
+
 	// we *could* stop the automated stat gathering here by sending close messages
 	// but we have found that gathering stats while the rabbitmq connection is broken
 	// to be rather handy
 	if p.stopCollectingOnNoConnection || force {
-        if !p.started {
-            return
-        }
+		if !p.started {
+			return
+		}
+		if force {
+			p.stopCarbon()
+		}
 		p.logger.Printf("STOP: Closing %d Plugins: ", len(p.jobs))
 		p.statsCollecting = false
-		for name, _ := range p.jobs {
+		for name, job := range p.jobs {
 			p.logger.Print("STOP: Closing Plugin: ", name)
 			p.close <- true
+
+			// let go of any socket, or the next Init cannot listen on it
+			if closer, ok := job.(io.Closer); ok {
+				if err := closer.Close(); nil != err {
+					p.logger.Printf("Failed to close %s: %v", name, err)
+				}
+			}
 		}
-		p.publishResultsChan <- false
-        p.started = false
-	} else {
+		p.stopResults()
+		p.started = false
+
+		// the next processor opens the store again once we are done with it
+		if nil != p.store {
+			if err := p.store.Close(); nil != err {
+				p.logger.Printf("Failed to close the stat store: %v", err)
+			}
+		}
+	} else if nil != p.resultsDone && !p.saving {
 		// tell our result publishing to stop.
+		p.saving = true
 		p.publishResultsChan <- true
 	}
 }
 
-func (p *PluginProcessor) loadResults() {
-	// get the results from file
-	f, err := os.OpenFile(p.statStore, os.O_RDWR|os.O_EXCL, 0600)
-	if err != nil {
+// stops handleResults, whichever of publishing or saving it is doing, and waits for it
+func (p *PluginProcessor) stopResults() {
+	if nil == p.resultsDone {
 		return
 	}
+	if p.saving {
+		p.saveResultsChan <- false
+	} else {
+		p.publishResultsChan <- false
+	}
+	<-p.resultsDone
+	p.resultsDone = nil
+	p.saving = false
+}
+
+// carbon keeps its own buffer, next to the stat store unless it is told otherwise
+func (p *PluginProcessor) openCarbon() error {
+	buffer := p.config.Carbon.Buffer.Path
+	if "" == buffer && "" != p.statStore {
+		buffer = p.statStore + ".carbon"
+	}
+	carbon, err := newCarbonSink(p.logger.Writer(), p.config.Carbon, buffer)
+	if nil != err {
+		return err
+	}
+	carbon.Start()
+	p.carbonLock.Lock()
+	p.carbon = carbon
+	p.carbonLock.Unlock()
+	return nil
+}
+
+// waits for any run that is sending to carbon, then closes the sink
+func (p *PluginProcessor) stopCarbon() {
+	p.carbonLock.Lock()
+	defer p.carbonLock.Unlock()
+	if nil != p.carbon {
+		p.carbon.Stop()
+		p.carbon = nil
+	}
+}
+
+// false when there is no carbon server to send to
+func (p *PluginProcessor) sendToCarbon(lines []byte) bool {
+	p.carbonLock.RLock()
+	defer p.carbonLock.RUnlock()
+	if nil == p.carbon {
+		return false
+	}
+	p.carbon.Send(lines)
+	return true
+}
+
+// the stat store lives in a directory next to where the old single file stat
+// store was. anything left in that file is moved into the new store
+func (p *PluginProcessor) openStatStore() error {
+	store, err := openStatStore(p.statStore+".wal", p.config.StatStore, p.logger)
+	if nil != err {
+		return err
+	}
+	if err = store.importLegacy(p.statStore); nil != err {
+		p.logger.Printf("Unable to import results from %s: %v", p.statStore, err)
+	}
+	p.store = store
+	return nil
+}
+
+// sends on up to limit of the results we stored while RabbitMQ was away, giving
+// way as soon as there are live results to publish. each one is only marked as
+// sent once it has been published, so whatever we don't get to is still there
+// next time. returns how many were sent and whether there are more to send
+func (p *PluginProcessor) replayResults(limit int) (int, bool) {
+	if nil == p.store {
+		return 0, false
+	}
+
+	// replayed results are batched whenever batching is on
+	size := p.config.Results.BatchSize
+	if size < 1 {
+		size = 1
+	}
+
+	replayed := 0
+	for replayed < limit {
+		// live results always go first
+		if p.results.Len() > 0 {
+			return replayed, true
+		}
+
+		var batch [][]byte
+		var next walPosition
+		var err error
+		for len(batch) < size && replayed+len(batch) < limit {
+			payload, after, readErr := p.store.Next()
+			if err = readErr; nil != err {
+				break
+			}
+			batch = append(batch, payload)
+			next = after
+		}
+		if nil != err && io.EOF != err {
+			p.logger.Printf("Unable to read the stat store: %v", err)
+		}
+		if 0 == len(batch) {
+			return replayed, false
+		}
+
+		var payload amqp.Publishing
+		if 1 == len(batch) {
+			payload = getRabbitPayload(batch[0])
+		} else if payload, err = getBatchPayload(batch); nil != err {
+			p.logger.Printf("Unable to batch stored results: %v", err)
+			p.store.Rewind()
+			return replayed, false
+		}
+		if err = p.q.Publish(RESULTS_QUEUE, "", payload); nil != err {
+			p.logger.Printf("Error Replaying Stats: %v.", err)
+			p.store.Rewind()
+			return replayed, false
+		}
+		p.store.Commit(next)
+		replayed += len(batch)
+	}
+	return replayed, true
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		sr := new(SavedResult)
-		sr.SetResult(scanner.Text())
-		p.results <- sr
+// how many stored results we may replay each replayTick, so a fleet of clients
+// reconnecting at once does not flood RabbitMQ with their backlog
+func (p *PluginProcessor) replayLimit() int {
+	rate := p.config.Results.ReplayRate
+	if rate <= 0 {
+		return math.MaxInt32
+	}
+	limit := rate * int(replayTick) / int(time.Second)
+	if limit < 1 {
+		limit = 1
 	}
+	return limit
+}
 
-	// once we have the contents of the file sent back to the result queue, truncate the file!
-	f.Truncate(0)
-	f.Close()
+// our results are published while we are connected to RabbitMQ and saved while
+// we are not, all from this one goroutine so there is only ever one replay of
+// the stat store going on
+func (p *PluginProcessor) handleResults(done chan bool) {
+	defer close(done)
+	for p.publishResults() && p.saveResults() {
+	}
 }
 
 // instead of writing the stats to RabbitMQ (i.e. rabbit connection has gone away)
-// we write them to a file instead, so that we may send them on once the connection
-// to rabbit has been reestablished
-func (p *PluginProcessor) saveResults() {
-	// does the stat store file exist?
-	p.logger.Printf("START: Disk store (%s) for results...", p.statStore)
-	var f *os.File
-	for {
-		select {
-		case result := <-p.results:
-			if result.HasOutput() {
-				finfo, err := os.Stat(p.statStore) // is there a file here?
-				if err != nil {
-					// no file? create one!
-					f, err = os.OpenFile(p.statStore, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
-				} else {
-					// oh, yes, let's open it (if we do not have too much in there already)
-					if finfo.Size() > 104857600 {
-						err = fmt.Errorf("The stat file is too large, discarding stat")
-					} else {
-						f, err = os.OpenFile(p.statStore, os.O_APPEND|os.O_WRONLY|os.O_EXCL, 0600)
-					}
-				}
+// we write them to the stat store instead, so that we may send them on once the
+// connection to rabbit has been reestablished. true when we should go back to publishing
+func (p *PluginProcessor) saveResults() bool {
+	p.logger.Printf("START: Disk store (%s.wal) for results...", p.statStore)
+
+	// with the interval policy we sync on a timer, the other policies ignore it
+	interval := statStoreSyncSeconds
+	if p.config.StatStore.FsyncInterval > 0 {
+		interval = p.config.StatStore.FsyncInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
 
-				if err != nil {
-					p.logger.Println("Cannot write to stat store,", err)
+	// whatever failed to publish before the connection went goes first
+	p.storeResults(p.retry)
 
-				} else {
-					f.Write(result.toJson())
-					f.WriteString("\n")
-					f.Close()
-				}
+	for {
+		select {
+		case <-p.results.Ready():
+			p.storeResults(p.results)
+		case <-ticker.C:
+			if nil != p.store {
+				p.store.Sync()
 			}
-		case <-p.saveResultsChan:
+		case publish := <-p.saveResultsChan:
 			p.logger.Println("STOP: Result saving to file...")
-			go p.publishResults()
+			if nil != p.store {
+				p.store.Flush()
+			}
+			return publish
+		}
+	}
+}
+
+// moves everything in a queue to the stat store
+func (p *PluginProcessor) storeResults(queue *resultQueue) {
+	for {
+		result, ok := queue.Pop()
+		if !ok {
 			return
 		}
+		if !result.HasOutput() {
+			continue
+		}
+		if nil == p.store {
+			p.logger.Println("Cannot write to stat store, it is not open")
+			continue
+		}
+		if err := p.store.Append(result.toJson()); nil != err {
+			p.logger.Println("Cannot write to stat store,", err)
+		}
+	}
+}
+
+// where results go when the queue is full and the overflow policy is spill
+func (p *PluginProcessor) spillResult(result ResultInterface) error {
+	if !result.HasOutput() {
+		return nil
 	}
+	return p.store.Append(result.toJson())
 }
 
-// our result publishing. will publish results until we call PluginProcessor.Stop()
-func (p *PluginProcessor) publishResults() {
-	go p.loadResults()
+// our result publishing. will publish results until we call PluginProcessor.Stop(),
+// true when we should save results until RabbitMQ is back
+func (p *PluginProcessor) publishResults() bool {
+	// stored results are replayed a little at a time, whenever there is nothing live to send
+	replaying := nil != p.store
+	if replaying {
+		p.store.Rewind()
+	}
+	replayed := 0
+	replay := time.NewTicker(replayTick)
+	defer replay.Stop()
+
+	batch := newResultBatch(p.config.Results.BatchSize)
+	var flush <-chan time.Time // fires when the batch has waited long enough
+
+	// failed publishes are retried on their own, so they never hold up new results
+	retry := time.NewTicker(p.retryInterval())
+	defer retry.Stop()
+
 	p.logger.Println("START: Result publishing to RabbitMQ...")
 	for {
-		//p.logger.Printf("Result Queue State: %d/%d\n", len(p.results), cap(p.results))
 		select {
-		case result := <-p.results:
-			if result.HasOutput() {
-				if err := p.q.Publish(RESULTS_QUEUE, "", result.GetPayload()); err != nil {
-					p.logger.Printf("Error Publishing Stats: %v.", err)
-					p.results <- result // requeue the failed result
+		case <-p.results.Ready():
+			for {
+				result, ok := p.results.Pop()
+				if !ok {
+					break
+				}
+				if !result.HasOutput() {
+					continue
+				}
+				if !p.batchable(result) {
+					p.publishResult(result)
+					continue
+				}
+				if batch.Add(result.toJson()) {
+					p.publishBatch(batch.Take())
+					flush = nil
+				} else if nil == flush {
+					flush = time.After(p.batchWait())
 				}
 			}
-		case cont := <-p.publishResultsChan:
-			p.logger.Print("STOP: Shutting down result publishing to RabbitMQ")
-			if cont {
-				go p.saveResults()
+		case <-flush:
+			flush = nil
+			p.publishBatch(batch.Take())
+		case <-replay.C:
+			if !replaying {
+				continue
 			}
+			var sent int
+			sent, replaying = p.replayResults(p.replayLimit())
+			replayed += sent
+			if !replaying {
+				p.store.Flush()
+				if replayed > 0 {
+					p.logger.Printf("Replayed %d stored results", replayed)
+				}
+				replayed = 0
+			}
+		case <-retry.C:
+			p.publishRetries()
+			// pick up anything spilled to the stat store, or left there by a failed replay
+			replaying = nil != p.store
+		case save := <-p.publishResultsChan:
+			if batch.Len() > 0 {
+				p.publishBatch(batch.Take())
+			}
+			p.logger.Print("STOP: Shutting down result publishing to RabbitMQ")
+			return save
+		}
+	}
+}
+
+// a result is turned into json once, so a retry sends exactly what we tried to send the first time
+func (p *PluginProcessor) publishResult(result ResultInterface) {
+	body := result.toJson()
+	if err := p.q.Publish(RESULTS_QUEUE, "", getRabbitPayload(body)); err != nil {
+		p.logger.Printf("Error Publishing Stats: %v.", err)
+		p.retryResult(body)
+	}
+}
+
+// sends a batch of results as one message, retrying them later if that fails
+func (p *PluginProcessor) publishBatch(results [][]byte) {
+	if 0 == len(results) {
+		return
+	}
+
+	payload, err := getBatchPayload(results)
+	if nil == err {
+		err = p.q.Publish(RESULTS_QUEUE, "", payload)
+	}
+	if nil != err {
+		p.logger.Printf("Error Publishing a batch of %d Stats: %v.", len(results), err)
+		for _, result := range results {
+			p.retryResult(result)
+		}
+	}
+}
+
+func (p *PluginProcessor) retryResult(body []byte) {
+	sr := new(SavedResult)
+	sr.SetResult(string(body))
+	p.retry.Push(sr)
+}
+
+// tries the failed results again, oldest first, until one fails
+func (p *PluginProcessor) publishRetries() {
+	for {
+		result, ok := p.retry.Peek()
+		if !ok {
+			return
+		}
+		if err := p.q.Publish(RESULTS_QUEUE, "", result.GetPayload()); nil != err {
+			p.logger.Printf("Error Retrying Stats: %v. %d results waiting", err, p.retry.Len())
 			return
 		}
+		p.retry.Remove(result)
+	}
+}
+
+func (p *PluginProcessor) retryInterval() time.Duration {
+	if p.config.Results.RetryInterval > 0 {
+		return time.Duration(p.config.Results.RetryInterval) * time.Second
+	}
+	return defaultRetryInterval * time.Second
+}
+
+// metrics are batched when batching is on, checks only when asked, so an alert is not held up
+func (p *PluginProcessor) batchable(result ResultInterface) bool {
+	if p.config.Results.BatchSize <= 1 {
+		return false
+	}
+	if priorityCheck == resultPriority(result) {
+		return p.config.Results.BatchChecks
+	}
+	return true
+}
+
+func (p *PluginProcessor) batchWait() time.Duration {
+	wait := p.config.Results.BatchWait
+	if wait <= 0 {
+		wait = defaultBatchWait
+	}
+	return time.Duration(wait) * time.Millisecond
+}
+
+// how the result pipeline is doing
+type ProcessorStats struct {
+	Queue           ResultQueueStats `json:"queue"`            // results waiting to be published
+	Retry           ResultQueueStats `json:"retry"`            // results waiting to be published again
+	StatStoreBytes  int64            `json:"stat_store_bytes"` // on disk, waiting to be replayed
+	Carbon          *CarbonStats     `json:"carbon,omitempty"` // nil when there is no carbon server
+	Truncated       int64            `json:"truncated"`        // results whose output was cut short
+	SubduedRuns     int64            `json:"subdued_runs"`     // scheduled runs skipped by a subdue window
+	SubduedRequests int64            `json:"subdued_requests"` // subscription requests dropped by a subdue window
+}
+
+func (p *PluginProcessor) Stats() ProcessorStats {
+	stats := ProcessorStats{
+		Queue:           p.results.Stats(),
+		Retry:           p.retry.Stats(),
+		Truncated:       atomic.LoadInt64(&p.counters.truncated),
+		SubduedRuns:     atomic.LoadInt64(&p.counters.subduedRuns),
+		SubduedRequests: atomic.LoadInt64(&p.counters.subduedRequests),
+	}
+	if nil != p.store {
+		stats.StatStoreBytes = p.store.Size()
+	}
+	p.carbonLock.RLock()
+	if nil != p.carbon {
+		carbonStats := p.carbon.Stats()
+		stats.Carbon = &carbonStats
 	}
+	p.carbonLock.RUnlock()
+	return stats
 }
 
 // determines if we can use one of our internet plugins to handle the check.
@@ -0,0 +1,323 @@
+package sensu
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bitly/go-simplejson"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"plugins"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_JobBackoff(t *testing.T) {
+	for i, tuple := range []struct {
+		interval time.Duration
+		failures int
+		ceiling  time.Duration
+		expected time.Duration
+	}{
+		{15 * time.Second, 1, 10 * time.Minute, 15 * time.Second},
+		{15 * time.Second, 2, 10 * time.Minute, 30 * time.Second},
+		{15 * time.Second, 4, 10 * time.Minute, 2 * time.Minute},
+		{15 * time.Second, 50, 10 * time.Minute, 10 * time.Minute},
+		// a ceiling below the interval never makes us run more often
+		{time.Hour, 3, 10 * time.Minute, time.Hour},
+	} {
+		if delay := jobBackoff(tuple.interval, tuple.failures, tuple.ceiling); delay != tuple.expected {
+			t.Errorf("%d. expected %s, got %s", i, tuple.expected, delay)
+		}
+	}
+}
+
+// a job that takes a while to gather
+type slowJob struct {
+	delay   time.Duration
+	running int32
+	most    int32 // the most runs we saw at once
+}
+
+func (j *slowJob) Init(config plugins.PluginConfig) (string, error) {
+	return config.Name, nil
+}
+
+func (j *slowJob) Gather(r *plugins.Result) error {
+	running := atomic.AddInt32(&j.running, 1)
+	for {
+		most := atomic.LoadInt32(&j.most)
+		if running <= most || atomic.CompareAndSwapInt32(&j.most, most, running) {
+			break
+		}
+	}
+	time.Sleep(j.delay)
+	atomic.AddInt32(&j.running, -1)
+	r.Add("slow.job 1")
+	return nil
+}
+
+func (j *slowJob) GetStatus() string {
+	return ""
+}
+
+func newTestProcessor(t *testing.T) *PluginProcessor {
+	p := NewPluginProcessor(ioutil.Discard, "")
+	p.config = &Config{Client: ClientConfig{Name: "test"}}
+	p.config.rawData, _ = simplejson.NewJson([]byte(`{"client":{"name":"test"}}`))
+	p.jobs = make(map[string]plugins.SensuPluginInterface)
+	p.close = make(chan bool, 10)
+	return p
+}
+
+// runs the scheduler for a job, the channel is closed once it has stopped
+func startScheduler(p *PluginProcessor, name string, job plugins.SensuPluginInterface) chan bool {
+	exited := make(chan bool)
+	go func() {
+		p.scheduleJob(name, job)
+		close(exited)
+	}()
+	return exited
+}
+
+// stops the schedulers and waits for any runs they started to finish
+func stopSchedulers(p *PluginProcessor, exited ...chan bool) {
+	for range exited {
+		p.close <- true
+	}
+	for _, e := range exited {
+		<-e
+	}
+	p.inFlight.Wait()
+}
+
+func Test_ScheduleJobSkipsOverlappingRuns(t *testing.T) {
+	p := newTestProcessor(t)
+	job := &slowJob{delay: 100 * time.Millisecond}
+	p.AddJob(job, plugins.PluginConfig{Name: "slow", Interval: 1})
+	p.schedules["slow"] = intervalSchedule{20 * time.Millisecond}
+
+	exited := startScheduler(p, "slow", job)
+	time.Sleep(250 * time.Millisecond)
+	stopSchedulers(p, exited)
+
+	if most := atomic.LoadInt32(&job.most); most > 1 {
+		t.Errorf("expected runs not to overlap, saw %d at once", most)
+	}
+	state := p.jobState("slow")
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if 0 == state.skipped {
+		t.Error("expected runs to be skipped while the job was running")
+	}
+}
+
+func Test_ScheduleJobConcurrencyLimit(t *testing.T) {
+	p := newTestProcessor(t)
+	p.slots = make(chan bool, 1)
+
+	job := &slowJob{delay: 50 * time.Millisecond}
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		p.AddJob(job, plugins.PluginConfig{Name: name, Interval: 1})
+		p.schedules[name] = intervalSchedule{10 * time.Millisecond}
+	}
+	var exited []chan bool
+	for _, name := range names {
+		exited = append(exited, startScheduler(p, name, job))
+	}
+	time.Sleep(200 * time.Millisecond)
+	stopSchedulers(p, exited...)
+
+	if most := atomic.LoadInt32(&job.most); most > 1 {
+		t.Errorf("expected one job at a time, saw %d at once", most)
+	}
+}
+
+// a job that always fails to gather, counting its runs
+type failingJob struct {
+	runs int32
+}
+
+func (j *failingJob) Init(config plugins.PluginConfig) (string, error) {
+	return config.Name, nil
+}
+
+func (j *failingJob) Gather(r *plugins.Result) error {
+	atomic.AddInt32(&j.runs, 1)
+	return fmt.Errorf("unable to gather")
+}
+
+func (j *failingJob) GetStatus() string {
+	return ""
+}
+
+func Test_ScheduleJobResumesWhileBackingOff(t *testing.T) {
+	p := newTestProcessor(t)
+	job := new(failingJob)
+	p.AddJob(job, plugins.PluginConfig{Name: "failing", Interval: 1})
+	p.schedules["failing"] = intervalSchedule{20 * time.Millisecond}
+
+	exited := startScheduler(p, "failing", job)
+	defer stopSchedulers(p, exited)
+
+	waitFor := func(what string, ok func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !ok() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// fail once, then pause while the job is backing off
+	waitFor("a failed run", func() bool { return p.jobState("failing").failureCount() > 0 })
+	p.PauseJob("failing")
+	time.Sleep(100 * time.Millisecond) // let any run in flight finish and the timer fire while paused
+	paused := atomic.LoadInt32(&job.runs)
+	time.Sleep(100 * time.Millisecond)
+	if runs := atomic.LoadInt32(&job.runs); runs != paused {
+		t.Errorf("expected no runs while paused, got %d more", runs-paused)
+	}
+
+	p.ResumeJob("failing")
+	waitFor("a run after resuming", func() bool { return atomic.LoadInt32(&job.runs) > paused })
+}
+
+// gathers a single metric with a long name
+type longMetricJob struct{}
+
+func (j *longMetricJob) Init(config plugins.PluginConfig) (string, error) {
+	return "long_metrics", nil
+}
+
+func (j *longMetricJob) Gather(r *plugins.Result) error {
+	r.AddMetric(strings.Repeat("x", 100), 1, nil)
+	return nil
+}
+
+func (j *longMetricJob) GetStatus() string {
+	return ""
+}
+
+func Test_RunJobLogsDroppedMetrics(t *testing.T) {
+	var logged bytes.Buffer
+	p := newTestProcessor(t)
+	p.logger = log.New(&logged, "", 0)
+
+	config := plugins.PluginConfig{Name: "long_metrics", Type: "metric", MaxOutputSize: 10}
+	if err := p.runJob("long_metrics", new(longMetricJob), config); nil != err {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logged.String(), "Dropped all the output of long_metrics") {
+		t.Errorf("expected dropping every metric to be logged, got %q", logged.String())
+	}
+	if 1 != atomic.LoadInt64(&p.counters.truncated) {
+		t.Errorf("expected the result to be counted as truncated")
+	}
+}
+
+func Test_StopClosesStatStore(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p := NewPluginProcessor(ioutil.Discard, filepath.Join(dir, "results"))
+	p.config = &Config{Client: ClientConfig{Name: "test"}}
+	p.close = make(chan bool, 1)
+	if err := p.openStatStore(); nil != err {
+		t.Fatal(err)
+	}
+	p.Start()
+	p.Stop(true)
+
+	if err := p.store.Append([]byte("after the reload")); errStatStoreClosed != err {
+		t.Errorf("expected the stat store to be closed when we stop, got %v", err)
+	}
+}
+
+// a plugin holding on to a socket
+type testListener struct {
+	closed bool
+}
+
+func (l *testListener) Init(config plugins.PluginConfig) (string, error) { return "listener", nil }
+func (l *testListener) Gather(r *plugins.Result) error                   { return nil }
+func (l *testListener) GetStatus() string                                { return "" }
+func (l *testListener) Close() error {
+	l.closed = true
+	return nil
+}
+
+func Test_StopClosesPlugins(t *testing.T) {
+	p := NewPluginProcessor(ioutil.Discard, "")
+	p.config = &Config{Client: ClientConfig{Name: "test"}}
+	p.close = make(chan bool, 1)
+	p.Start()
+
+	listener := new(testListener)
+	p.jobs = map[string]plugins.SensuPluginInterface{"listener": listener}
+	p.Stop(true)
+	if !listener.closed {
+		t.Error("expected the plugin to be closed when we stop, so the next one can listen")
+	}
+}
+
+// a reconnect hands results back to the one publisher we have, rather than starting another
+func Test_ReconnectKeepsOnePublisher(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	var logged bytes.Buffer
+	p := NewPluginProcessor(ioutil.Discard, filepath.Join(dir, "results"))
+	p.logger = log.New(&logged, "", 0)
+	p.config = &Config{Client: ClientConfig{Name: "test"}}
+	p.q = new(noTransport)
+	p.close = make(chan bool, 1)
+	if err := p.openStatStore(); nil != err {
+		t.Fatal(err)
+	}
+
+	p.Start()
+	p.Stop(false) // RabbitMQ goes away
+	p.Stop(false)
+	p.Start() // and comes back
+	p.Stop(false)
+	p.Stop(true) // shutting down while disconnected
+
+	if started := strings.Count(logged.String(), "START: Result publishing"); 2 != started {
+		t.Errorf("expected publishing to start once per connection, it started %d times", started)
+	}
+	if saved := strings.Count(logged.String(), "START: Disk store"); 2 != saved {
+		t.Errorf("expected saving to start once per disconnection, it started %d times", saved)
+	}
+}
+
+func Test_StatStoreKeptWithoutRabbitmq(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results")
+
+	store := newTestStatStore(t, path+".wal", StatStoreConfig{})
+	store.Append([]byte(`{"client":"test","check":{"name":"cpu_metrics","output":"stored"}}`))
+	store.Close()
+
+	p := NewPluginProcessor(ioutil.Discard, path)
+	config := &Config{Client: ClientConfig{Name: "test"}, Rabbitmq: RabbitmqConfig{Disabled: true}}
+	config.rawData, _ = simplejson.NewJson([]byte(`{"client":{"name":"test"}}`))
+	if err := p.Init(new(noTransport), config); nil != err {
+		t.Fatal(err)
+	}
+	p.Start()
+	time.Sleep(3 * replayTick)
+	p.Stop(true)
+
+	store = newTestStatStore(t, path+".wal", StatStoreConfig{})
+	defer store.Close()
+	if replayed := drainStatStore(t, store); 1 != len(replayed) {
+		t.Errorf("expected the stored result to wait for RabbitMQ, got %v", replayed)
+	}
+}
@@ -9,22 +9,29 @@ import (
 	"plugins"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const RESULTS_QUEUE = "results"
 
 type check struct {
-	Name       string   `json:"name"`       // the check name in sensu
-	Command    string   `json:"command"`    // the "command" that was run
-	Executed   uint     `json:"executed"`   // timestamp for when this check was started
-	Issued     uint     `json:"issued"`     // timestamp for when this check was sent
-	Status     int      `json:"status"`     // the status for the check. 0 = success. > 0 = fail
-	Output     string   `json:"output"`     // the output of the check script
-	Duration   float64  `json:"duration"`   // how long it took to run the check. this needs to be transformed to "seconds.milliseconds
-	CheckType  string   `json:"type"`       // "metric|???"
-	Handlers   []string `json:"handlers"`   // how this data is processed
-	Interval   int      `json:"interval"`   // how long between checks, in seconds
-	Standalone bool     `json:"standalone"` // was this check unsolicited?
+	Name       string   `json:"name"`               // the check name in sensu
+	Command    string   `json:"command"`            // the "command" that was run
+	Executed   uint     `json:"executed"`           // timestamp for when this check was started
+	Issued     uint     `json:"issued"`             // timestamp for when this check was sent
+	Status     int      `json:"status"`             // the status for the check. 0 = success. > 0 = fail
+	Output     string   `json:"output"`             // the output of the check script
+	Duration   float64  `json:"duration"`           // how long it took to run the check. this needs to be transformed to "seconds.milliseconds
+	CheckType  string   `json:"type"`               // "metric|???"
+	Handlers   []string `json:"handlers"`           // how this data is processed
+	Interval   int      `json:"interval"`           // how long between checks, in seconds
+	Standalone bool     `json:"standalone"`         // was this check unsolicited?
+	History    []string `json:"history,omitempty"`  // the statuses of the last 21 runs, oldest first
+	Flapping   bool     `json:"flapping,omitempty"` // whether or not the check keeps changing state
+
+	Hooks []hookResult `json:"hooks,omitempty"` // the output of the hook run for this status
+
+	Custom map[string]interface{} `json:"-"` // attributes from the check config we know nothing about
 
 	Address string `json:"-"` // usage unknown
 
@@ -34,6 +41,26 @@ type check struct {
 	time_taken time.Duration
 }
 
+// custom attributes go alongside the rest, but never replace one of ours
+func (c check) MarshalJSON() ([]byte, error) {
+	type plain check
+	body, err := json.Marshal(plain(c))
+	if nil != err || 0 == len(c.Custom) {
+		return body, err
+	}
+
+	var merged map[string]interface{}
+	if err = json.Unmarshal(body, &merged); nil != err {
+		return nil, err
+	}
+	for key, value := range c.Custom {
+		if _, ok := merged[key]; !ok {
+			merged[key] = value
+		}
+	}
+	return json.Marshal(merged)
+}
+
 type ResultInterface interface {
 	HasOutput() bool
 	GetPayload() amqp.Publishing
@@ -46,6 +73,10 @@ type Result struct {
 	Check             check  `json:"check"`
 	checkStatus       string // for checks we want to know if they are critical/warning/unknown/ok
 	wrapOutput        bool
+	outputFormat      string         // how metrics are written, the original graphite lines when empty
+	outputTemplate    metricTemplate // maps graphite names to tags for the tag based formats
+	maxOutputSize     int            // bytes of output kept, no limit when 0
+	truncated         bool           // output was thrown away to keep under maxOutputSize
 }
 
 type SavedResult struct {
@@ -58,13 +89,8 @@ func NewResult(clientConfig ClientConfig, check_name string) *Result {
 	result.wrapOutput = true
 
 	result.Client = clientConfig.Name
-	// host name schema is stb.<location-name>.loc.swiftnetworks.com.au
-	bits := strings.Split(result.Client, ".")
-	if "stb" == bits[0] {
-		result.client_short_name = fmt.Sprintf("%s.%s", bits[0], bits[1])
-	} else {
-		result.client_short_name = bits[0]
-	}
+	result.maxOutputSize = clientConfig.MaxOutputSize
+	result.client_short_name = shortName(result.Client)
 
 	result.Check.Name = check_name
 	result.Check.Address = clientConfig.Address
@@ -80,56 +106,175 @@ func NewResult(clientConfig ClientConfig, check_name string) *Result {
 	return result
 }
 
+// a check result telling the server that a job could not gather its data
+func newErrorResult(clientConfig ClientConfig, check_name string, config plugins.PluginConfig, err error) *Result {
+	result := NewResult(clientConfig, check_name)
+	result.SetCheckConfig(config)
+	result.SetType("check")
+	result.SetHandlers(config.Handlers)
+	result.SetStatus(plugins.UNKNOWN.ToInt())
+	result.SetCheckStatus(plugins.UNKNOWN.ToString())
+	result.SetOutput([]plugins.ResultStat{{Output: err.Error()}})
+	return result
+}
+
+// takes the type, handlers, interval and custom attributes from the check config
+func (r *Result) SetCheckConfig(config plugins.PluginConfig) {
+	r.Check.Command = config.Command
+	if "" != config.Type {
+		r.Check.CheckType = config.Type
+	}
+	if "metric" != r.Check.CheckType || len(config.Handlers) > 0 {
+		r.SetHandlers(config.Handlers)
+	}
+	r.Check.Interval = int(config.Interval)
+	r.Check.Standalone = config.Standalone
+	r.Check.Custom = config.Custom
+	r.outputFormat = config.OutputFormat
+	r.outputTemplate = parseMetricTemplate(config.OutputTemplate)
+	if config.MaxOutputSize > 0 {
+		r.maxOutputSize = config.MaxOutputSize
+	}
+}
+
+// fills in what a plugin gathered. checks get the status they report, metrics
+// have no status of their own and are OK when they gather. a check that has
+// not been given a type is a standard check, not a metric
+func (r *Result) SetGathered(description string, config plugins.PluginConfig, gathered *plugins.Result) plugins.Status {
+	status, isCheck := plugins.ParseStatus(description)
+	if isCheck && "" == config.Type {
+		r.SetType("check")
+		r.SetHandlers(config.Handlers)
+	}
+
+	r.SetStatus(status.ToInt())
+	r.SetCheckStatus(description)
+	r.SetWrapOutput(!gathered.IsNoWrapOutput()) // for external checks
+	r.SetOutput(gathered.Output())
+	return status
+}
+
 // takes each of our lines of output and prefixes the system we are checking
-// and suffixes the timestamp when we checked
+// and suffixes the timestamp when we checked. check output starts with the
+// status, e.g. "CheckProcs CRITICAL: Found 0 matching processes"
 func (r *Result) SetOutput(rows []plugins.ResultStat) {
+	var output string
 
 	switch r.Check.CheckType {
 	case "metric":
-		if !r.wrapOutput { // mainly for external metrics that provide their own fully qualified lines of output
-			for _, row := range rows {
-				r.Check.Output += row.Output + "\n"
+		if formatter, ok := metricFormatters[r.outputFormat]; ok {
+			points := metricPoints(rows, r.ShortName(), r.wrapOutput, r.StartTime())
+			for i := range points {
+				r.outputTemplate.apply(&points[i], r.Client)
+			}
+			output = formatter(points)
+			break
+		}
+		if "" != r.outputFormat {
+			log.Printf("Unknown output_format %q for %s, using graphite", r.outputFormat, r.Check.Name)
+		}
+
+		for _, row := range rows {
+			if row.IsMetric() { // typed metrics are always written by a formatter
+				output += formatGraphitePoints(metricPoints([]plugins.ResultStat{row}, r.ShortName(), true, r.StartTime()))
+				continue
 			}
-		} else {
-			var t uint
-			for _, row := range rows {
-				if row.TimeIsSet {
-					t = uint(row.Time.Unix())
-				} else {
-					t = r.StartTime()
-				}
-
-				r.Check.Output += fmt.Sprintf("%s.%s %d\n", r.ShortName(), row.Output, t)
+			if !r.wrapOutput { // mainly for external metrics that provide their own fully qualified lines of output
+				output += row.Output + "\n"
+				continue
 			}
+
+			t := r.StartTime()
+			if row.TimeIsSet {
+				t = uint(row.Time.Unix())
+			}
+			output += fmt.Sprintf("%s.%s %d\n", r.ShortName(), row.Output, t)
 		}
-	case "check":
+	default:
 		for _, row := range rows {
-			r.Check.Output += row.Output
+			output += row.Output
+		}
+		if "" != r.checkStatus {
+			output = r.checkStatus + ": " + output
 		}
 	}
+
+	r.appendOutput(output)
+}
+
+// adds to the output, keeping it within maxOutputSize. check output is cut
+// short with a note of how much there was, metric output loses its last lines
+// so that every line left is whole, which leaves nothing at all when the first
+// line is over the limit
+func (r *Result) appendOutput(output string) {
+	if r.truncated {
+		return
+	}
+
+	output = r.Check.Output + output
+	limit := r.outputLimit()
+	if limit < 0 || len(output) <= limit {
+		r.Check.Output = output
+		return
+	}
+
+	r.truncated = true
+	if "metric" == r.Check.CheckType {
+		r.Check.Output = output[:strings.LastIndex(output[:limit], "\n")+1]
+		return
+	}
+
+	r.Check.Output = truncateOutput(output, len(output), limit)
+}
+
+// the bytes of output we keep, -1 when there is no limit. toJson ends the
+// output with a newline, which comes out of max_output_size too
+func (r *Result) outputLimit() int {
+	if r.maxOutputSize <= 0 {
+		return -1
+	}
+	return r.maxOutputSize - 1
+}
+
+// cuts output down to limit bytes, ending it with a note of how many bytes
+// there were in all. a limit smaller than the note gets as much of it as fits
+func truncateOutput(output string, total int, limit int) string {
+	marker := fmt.Sprintf("\n[output truncated, %d bytes in all]", total)
+	if len(marker) > limit {
+		marker = marker[:limit]
+	}
+	keep := limit - len(marker)
+	if keep > len(output) {
+		keep = len(output)
+	}
+	// don't leave half a character behind
+	for keep > 0 && keep < len(output) && !utf8.RuneStart(output[keep]) {
+		keep--
+	}
+	return output[:keep] + marker
 }
 
+// whether output was thrown away to keep under the max_output_size
+func (r *Result) Truncated() bool {
+	return r.truncated
+}
+
+// the status as the check describes it, set before SetOutput so the output starts with it
 func (r *Result) SetCheckStatus(s string) {
 	r.checkStatus = s
 }
 
 func (r *Result) Output() string {
-	var output string
-	switch r.Check.CheckType {
-	case "metric":
-		output = r.Check.Output
-	case "check":
-		output = r.checkStatus + ": " + r.Check.Output
-	}
-	return output
+	return r.Check.Output
 }
 
 func (r *Result) HasOutput() bool {
 	return "" != r.Check.Output
 }
 
-func (r *Result) SetInterval(interval time.Duration) {
-	r.Check.Interval = int(interval / time.Second)
+// the start of each metric name, see metricPrefix
+func (r *Result) SetMetricPrefix(prefix string) {
+	r.client_short_name = prefix
 }
 
 func (r *Result) ShortName() string {
@@ -152,6 +297,19 @@ func (r *Result) SetType(checktype string) {
 	r.Check.CheckType = checktype
 }
 
+// check results go to the default handler unless told otherwise
+func (r *Result) SetHandlers(handlers []string) {
+	if 0 == len(handlers) {
+		handlers = []string{"default"}
+	}
+	r.Check.Handlers = handlers
+}
+
+func (r *Result) SetHistory(history []string, flapping bool) {
+	r.Check.History = history
+	r.Check.Flapping = flapping
+}
+
 func (r *Result) SetWrapOutput(wrapOutput bool) {
 	r.wrapOutput = wrapOutput
 }
@@ -171,7 +329,7 @@ func (result *Result) toJson() []byte {
 		log.Panic(err)
 	}
 	if "" != os.Getenv("DEBUG") {
-		log.Printf(string(json)) // handy json debug printing
+		log.Print(string(json)) // handy json debug printing
 	}
 	return json
 }
@@ -0,0 +1,154 @@
+package sensu
+
+import (
+	"encoding/json"
+	"plugins"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type statusJob struct {
+	description string
+}
+
+func (j *statusJob) Init(plugins.PluginConfig) (string, error) { return "status", nil }
+func (j *statusJob) Gather(r *plugins.Result) error {
+	r.Add("Found 0 matching processes")
+	return nil
+}
+func (j *statusJob) GetStatus() string { return j.description }
+
+func decodeResult(t *testing.T, result *Result) map[string]interface{} {
+	var decoded struct {
+		Check map[string]interface{} `json:"check"`
+	}
+	if err := json.Unmarshal(result.toJson(), &decoded); nil != err {
+		t.Fatal(err)
+	}
+	return decoded.Check
+}
+
+func Test_CheckResultStatus(t *testing.T) {
+	config := newCheckConfig(map[string]interface{}{
+		"command":  "check_procs -p sshd",
+		"handlers": []interface{}{"pagerduty"},
+		"interval": float64(60),
+		"team":     "ops",
+	})
+	job := &statusJob{"CheckProcs CRITICAL"}
+
+	result := NewResult(ClientConfig{Name: "test"}, "sshd")
+	result.SetCheckConfig(config)
+	gathered := new(plugins.Result)
+	job.Gather(gathered)
+	if status := result.SetGathered(job.GetStatus(), config, gathered); plugins.CRITICAL != status {
+		t.Errorf("expected CRITICAL, got %s", status.ToString())
+	}
+
+	check := decodeResult(t, result)
+	if 2.0 != check["status"] || "check" != check["type"] || 60.0 != check["interval"] {
+		t.Errorf("expected a CRITICAL check run every minute, got %v", check)
+	}
+	if handlers, _ := check["handlers"].([]interface{}); 1 != len(handlers) || "pagerduty" != handlers[0] {
+		t.Errorf("expected the configured handlers, got %v", check["handlers"])
+	}
+	if "CheckProcs CRITICAL: Found 0 matching processes\n" != check["output"] {
+		t.Errorf("expected the status at the start of the output, got %q", check["output"])
+	}
+	if "ops" != check["team"] {
+		t.Errorf("expected the custom attribute to be passed on, got %v", check["team"])
+	}
+}
+
+func Test_MetricResultDefaults(t *testing.T) {
+	config := newCheckConfig(map[string]interface{}{"command": "cpu_metrics", "name": "shadowed"})
+
+	result := NewResult(ClientConfig{Name: "stb.site.loc"}, "cpu_metrics")
+	result.SetCheckConfig(config)
+	gathered := new(plugins.Result)
+	gathered.Add("cpu.user 1")
+	if status := result.SetGathered("", config, gathered); plugins.OK != status {
+		t.Errorf("expected a metric to be OK, got %s", status.ToString())
+	}
+
+	check := decodeResult(t, result)
+	if 0.0 != check["status"] || "metric" != check["type"] {
+		t.Errorf("expected an OK metric, got %v", check)
+	}
+	if handlers, _ := check["handlers"].([]interface{}); 1 != len(handlers) || "metrics" != handlers[0] {
+		t.Errorf("expected the metrics handler, got %v", check["handlers"])
+	}
+	if "cpu_metrics" != check["name"] {
+		t.Errorf("expected a custom attribute never to replace one of ours, got %v", check["name"])
+	}
+}
+
+func Test_MaxOutputSize(t *testing.T) {
+	// the client limit applies to checks without one of their own
+	config := newCheckConfig(map[string]interface{}{"command": "check_log", "type": "check"})
+	result := NewResult(ClientConfig{Name: "test", MaxOutputSize: 64}, "check_log")
+	result.SetCheckConfig(config)
+	gathered := new(plugins.Result)
+	gathered.Add(strings.Repeat("é", 100))
+	result.SetGathered("CheckLog WARNING", config, gathered)
+
+	output := result.Output()
+	if !result.Truncated() || len(output) > 64 {
+		t.Errorf("expected the output to be cut to 64 bytes, got %d: %q", len(output), output)
+	}
+	if !strings.HasPrefix(output, "CheckLog WARNING: é") || !strings.HasSuffix(output, "\n[output truncated, 218 bytes in all]") {
+		t.Errorf("expected the start of the output and a marker, got %q", output)
+	}
+	if !utf8.ValidString(output) {
+		t.Errorf("expected whole characters, got %q", output)
+	}
+	var sent Result
+	json.Unmarshal(result.toJson(), &sent)
+	if 64 != len(sent.Check.Output) {
+		t.Errorf("expected the output sent to fill the 64 bytes with its newline, got %d: %q", len(sent.Check.Output), sent.Check.Output)
+	}
+
+	// metrics lose whole lines, and the check's limit beats the client's
+	config = newCheckConfig(map[string]interface{}{"command": "cpu_metrics", "max_output_size": float64(40)})
+	result = NewResult(ClientConfig{Name: "stb.site", MaxOutputSize: 1024}, "cpu_metrics")
+	result.SetCheckConfig(config)
+	gathered = new(plugins.Result)
+	gathered.AddMetric("cpu.user", 1, nil)
+	gathered.AddMetric("cpu.system", 2, nil)
+	result.SetGathered("", config, gathered)
+
+	if !result.Truncated() || !strings.HasPrefix(result.Output(), "stb.site.cpu.user 1 ") || strings.Count(result.Output(), "\n") != 1 {
+		t.Errorf("expected only the first line of metrics, got %q", result.Output())
+	}
+
+	// a first line over the limit leaves no metrics at all
+	config = newCheckConfig(map[string]interface{}{"command": "cpu_metrics", "max_output_size": float64(10)})
+	result = NewResult(ClientConfig{Name: "stb.site"}, "cpu_metrics")
+	result.SetCheckConfig(config)
+	gathered = new(plugins.Result)
+	gathered.AddMetric("cpu.user", 1, nil)
+	result.SetGathered("", config, gathered)
+	if !result.Truncated() || "" != result.Output() {
+		t.Errorf("expected all of the metrics to be dropped, got %q", result.Output())
+	}
+
+	// a limit smaller than the marker still holds
+	config = newCheckConfig(map[string]interface{}{"command": "check_log", "type": "check", "max_output_size": float64(10)})
+	result = NewResult(ClientConfig{Name: "test"}, "check_log")
+	result.SetCheckConfig(config)
+	gathered = new(plugins.Result)
+	gathered.Add(strings.Repeat("x", 100))
+	result.SetGathered("CheckLog WARNING", config, gathered)
+	if output := result.Output(); !result.Truncated() || "\n[output " != output {
+		t.Errorf("expected the marker cut to 9 bytes, leaving room for the newline, got %q", output)
+	}
+
+	// under the limit nothing changes
+	result = NewResult(ClientConfig{Name: "test", MaxOutputSize: 1024}, "cpu_metrics")
+	result.SetCheckConfig(newCheckConfig(map[string]interface{}{"command": "cpu_metrics"}))
+	result.SetOutput([]plugins.ResultStat{{Output: "cpu.user 1"}})
+	if result.Truncated() {
+		t.Errorf("expected short output to be left alone, got %q", result.Output())
+	}
+}
@@ -0,0 +1,186 @@
+package sensu
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"plugins"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPrometheusPath = "/metrics"
+
+// serves the latest values from our metrics checks for Prometheus to scrape
+type PrometheusExporter struct {
+	listen   string
+	path     string
+	logger   *log.Logger
+	server   *http.Server
+	listener net.Listener
+
+	lock   sync.RWMutex
+	checks map[string][]plugins.ResultStat // the typed metrics from the last run of each check
+}
+
+func NewPrometheusExporter(w io.Writer, config PrometheusConfig) *PrometheusExporter {
+	e := new(PrometheusExporter)
+	e.logger = log.New(w, "Prometheus: ", log.LstdFlags)
+	e.listen = config.Listen
+	e.path = config.Path
+	if "" == e.path {
+		e.path = defaultPrometheusPath
+	}
+	e.checks = make(map[string][]plugins.ResultStat)
+	return e
+}
+
+func (e *PrometheusExporter) Start() error {
+	listener, err := net.Listen("tcp", e.listen)
+	if nil != err {
+		return fmt.Errorf("Prometheus endpoint: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(e.path, e)
+	e.server = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	e.listener = listener
+
+	e.logger.Printf("Serving metrics on http://%s%s", listener.Addr(), e.path)
+	go e.server.Serve(listener)
+	return nil
+}
+
+func (e *PrometheusExporter) Stop() {
+	if nil != e.server {
+		e.logger.Print("STOP: Closing the metrics endpoint")
+		e.server.Close()
+		e.server = nil
+	}
+}
+
+// keeps the typed metrics from a run of a check, replacing those from its last run
+func (e *PrometheusExporter) Update(check string, rows []plugins.ResultStat) {
+	var metrics []plugins.ResultStat
+	for _, row := range rows {
+		if row.IsMetric() {
+			metrics = append(metrics, row)
+		}
+	}
+	if 0 == len(metrics) {
+		return
+	}
+
+	e.lock.Lock()
+	e.checks[check] = metrics
+	e.lock.Unlock()
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.lock.RLock()
+	families := prometheusFamilies(e.checks)
+	e.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range families {
+		io.WriteString(w, family.String())
+	}
+}
+
+// the samples sharing a metric name, with their help and type lines
+type prometheusFamily struct {
+	name    string
+	help    string
+	counter bool
+	samples []string
+}
+
+func (f *prometheusFamily) String() string {
+	kind := "gauge"
+	if f.counter {
+		kind = "counter"
+	}
+	sort.Strings(f.samples)
+	return fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n%s\n", f.name, f.help, f.name, kind, strings.Join(f.samples, "\n"))
+}
+
+// groups the metrics of every check into families, in name order
+func prometheusFamilies(checks map[string][]plugins.ResultStat) []*prometheusFamily {
+	names := make([]string, 0, len(checks))
+	for check := range checks {
+		names = append(names, check)
+	}
+	sort.Strings(names)
+
+	byName := make(map[string]*prometheusFamily)
+	var families []*prometheusFamily
+	for _, check := range names {
+		for _, metric := range checks[check] {
+			name := prometheusName(metric)
+			family, ok := byName[name]
+			if !ok {
+				family = &prometheusFamily{name: name, help: "Gathered by " + check, counter: metric.Counter}
+				byName[name] = family
+				families = append(families, family)
+			}
+			family.samples = append(family.samples, name+prometheusLabels(metric.Tags)+" "+plugins.FormatValue(metric.Value))
+		}
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+var prometheusInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func prometheusSanitise(name string) string {
+	name = prometheusInvalid.ReplaceAllString(name, "_")
+	if "" != name && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// the metric name without the parts its tags already say, so that
+// interface.eth0.rx_bytes with interface=eth0 becomes interface_rx_bytes
+func prometheusName(metric plugins.ResultStat) string {
+	values := make(map[string]bool, len(metric.Tags))
+	for _, value := range metric.Tags {
+		values[value] = true
+	}
+
+	var parts []string
+	for _, part := range strings.Split(metric.Name, ".") {
+		if values[part] {
+			delete(values, part)
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return prometheusSanitise(strings.Join(parts, "_"))
+}
+
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabels(tags map[string]string) string {
+	if 0 == len(tags) {
+		return ""
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := make([]string, 0, len(keys))
+	for _, key := range keys {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, prometheusSanitise(key), prometheusEscaper.Replace(tags[key])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
@@ -0,0 +1,87 @@
+package sensu
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"plugins"
+	"strings"
+	"testing"
+)
+
+func Test_PrometheusExporter(t *testing.T) {
+	e := NewPrometheusExporter(ioutil.Discard, PrometheusConfig{})
+
+	network := new(plugins.Result)
+	network.AddCounter("interface.eth0.rx_bytes", 1048576, map[string]string{"interface": "eth0"})
+	network.AddCounter("interface.wlan0.rx_bytes", 512, map[string]string{"interface": "wlan0"})
+	e.Update("interface_metrics", network.Output())
+
+	load := new(plugins.Result)
+	load.AddMetric("load_avg.one", 0.5, nil)
+	load.Add("not a typed metric")
+	e.Update("load_metrics", load.Output())
+
+	// only the latest run of a check is served
+	load = new(plugins.Result)
+	load.AddMetric("load_avg.one", 0.25, nil)
+	e.Update("load_metrics", load.Output())
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := `# HELP interface_rx_bytes Gathered by interface_metrics
+# TYPE interface_rx_bytes counter
+interface_rx_bytes{interface="eth0"} 1048576
+interface_rx_bytes{interface="wlan0"} 512
+# HELP load_avg_one Gathered by load_metrics
+# TYPE load_avg_one gauge
+load_avg_one 0.25
+`
+	if expected != w.Body.String() {
+		t.Errorf("expected\n%s\ngot\n%s", expected, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("expected the prometheus text format, got %s", w.Header().Get("Content-Type"))
+	}
+}
+
+func Test_PrometheusNames(t *testing.T) {
+	var tests = []struct {
+		name     string
+		tags     map[string]string
+		expected string
+	}{
+		{"cpu.cpu0.user", map[string]string{"cpu": "cpu0"}, "cpu_user"},
+		{"cpu.total.user", map[string]string{"cpu": "total"}, "cpu_user"},
+		{"tcp.latency.db-1.ms", map[string]string{"target": "db-1"}, "tcp_latency_ms"},
+		{"tcp.try-count.db-1", map[string]string{"target": "db-1"}, "tcp_try_count"},
+		{"memory.swapUsed", nil, "memory_swapUsed"},
+		{"2xx.count", nil, "_2xx_count"},
+	}
+	for _, test := range tests {
+		if name := prometheusName(plugins.ResultStat{Name: test.name, Tags: test.tags}); test.expected != name {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, name)
+		}
+	}
+
+	if labels := prometheusLabels(map[string]string{"target": `a"b`, "cpu": "cpu0"}); `{cpu="cpu0",target="a\"b"}` != labels {
+		t.Errorf("expected sorted, escaped labels, got %s", labels)
+	}
+}
+
+func Test_PrometheusExporterListens(t *testing.T) {
+	e := NewPrometheusExporter(ioutil.Discard, PrometheusConfig{Listen: "127.0.0.1:0"})
+	if err := e.Start(); nil != err {
+		t.Fatal(err)
+	}
+	defer e.Stop()
+
+	resp, err := http.Get("http://" + e.listener.Addr().String() + "/metrics")
+	if nil != err {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if http.StatusOK != resp.StatusCode {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,93 @@
+package sensu
+
+import (
+	"math"
+	"plugins"
+	"strconv"
+	"strings"
+)
+
+// when a job's results are sent to the server
+const (
+	publishAlways = "always" // every run, the classic sensu way
+	publishChange = "change" // when the status changes, and every heartbeat runs
+	publishDelta  = "delta"  // as with change, or when a metric moves by more than the delta
+)
+
+// with change and delta, a result is sent at least this often so the server knows we are alive
+const defaultPublishHeartbeat = 20
+
+// pulls the values out of metric lines like "load_avg.one 0.15 1430000000"
+func metricValues(rows []plugins.ResultStat) map[string]string {
+	values := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if row.IsMetric() {
+			values[row.Name] = plugins.FormatValue(row.Value)
+			continue
+		}
+		for _, line := range strings.Split(row.Output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				values[fields[0]] = fields[1]
+			}
+		}
+	}
+	return values
+}
+
+// whether or not any metric came or went, or moved by more than delta. values
+// that aren't numbers have changed when they are different at all
+func valuesChanged(last, current map[string]string, delta float64) bool {
+	if len(last) != len(current) {
+		return true
+	}
+	for name, value := range current {
+		previous, ok := last[name]
+		if !ok {
+			return true
+		}
+		if previous == value {
+			continue
+		}
+
+		a, errA := strconv.ParseFloat(previous, 64)
+		b, errB := strconv.ParseFloat(value, 64)
+		if nil != errA || nil != errB || math.Abs(b-a) > delta {
+			return true
+		}
+	}
+	return false
+}
+
+// decides whether a run's result is worth sending, remembering what was last
+// sent when it is. values are only looked at with the delta policy
+func (s *jobState) shouldPublish(config plugins.PluginConfig, status plugins.Status, values map[string]string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	publish := true
+	switch config.Publish {
+	case publishChange, publishDelta:
+		heartbeat := config.Heartbeat
+		if heartbeat <= 0 {
+			heartbeat = defaultPublishHeartbeat
+		}
+
+		publish = !s.published || s.publishedStatus != status || s.sincePublished+1 >= heartbeat
+		if !publish && publishDelta == config.Publish {
+			publish = valuesChanged(s.publishedValues, values, config.Delta)
+		}
+	}
+
+	if !publish {
+		s.sincePublished++
+		s.suppressed++
+		return false
+	}
+
+	s.published = true
+	s.publishedStatus = status
+	s.publishedValues = values
+	s.sincePublished = 0
+	return true
+}
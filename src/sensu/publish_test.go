@@ -0,0 +1,100 @@
+package sensu
+
+import (
+	"plugins"
+	"testing"
+)
+
+func Test_MetricValues(t *testing.T) {
+	values := metricValues([]plugins.ResultStat{
+		{Output: "load_avg.one 0.15"},
+		{Output: "custom.a 1 1430000000\ncustom.b 2 1430000000\n"},
+		{Output: "garbage"},
+	})
+
+	expected := map[string]string{"load_avg.one": "0.15", "custom.a": "1", "custom.b": "2"}
+	if len(expected) != len(values) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+	for name, value := range expected {
+		if values[name] != value {
+			t.Errorf("expected %s to be %s, got %s", name, value, values[name])
+		}
+	}
+}
+
+func Test_ValuesChanged(t *testing.T) {
+	last := map[string]string{"a": "1.0", "b": "up"}
+
+	var tests = []struct {
+		current  map[string]string
+		delta    float64
+		expected bool
+	}{
+		{map[string]string{"a": "1.0", "b": "up"}, 0, false},
+		{map[string]string{"a": "1.4", "b": "up"}, 0.5, false},
+		{map[string]string{"a": "1.6", "b": "up"}, 0.5, true},
+		{map[string]string{"a": "1.0", "b": "down"}, 0.5, true},
+		{map[string]string{"a": "1.0"}, 0.5, true},
+		{map[string]string{"a": "1.0", "c": "up"}, 0.5, true},
+	}
+
+	for i, test := range tests {
+		if changed := valuesChanged(last, test.current, test.delta); test.expected != changed {
+			t.Errorf("%d: expected changed to be %v", i, test.expected)
+		}
+	}
+}
+
+func Test_ShouldPublish(t *testing.T) {
+	var tests = []struct {
+		config   plugins.PluginConfig
+		statuses []plugins.Status
+		expected []bool
+	}{
+		{
+			plugins.PluginConfig{Publish: publishAlways},
+			[]plugins.Status{plugins.OK, plugins.OK},
+			[]bool{true, true},
+		},
+		{
+			plugins.PluginConfig{Publish: publishChange, Heartbeat: 3},
+			[]plugins.Status{plugins.OK, plugins.OK, plugins.CRITICAL, plugins.CRITICAL, plugins.CRITICAL, plugins.CRITICAL, plugins.OK},
+			[]bool{true, false, true, false, false, true, true},
+		},
+	}
+
+	for i, test := range tests {
+		state := new(jobState)
+		for j, status := range test.statuses {
+			if publish := state.shouldPublish(test.config, status, nil); test.expected[j] != publish {
+				t.Errorf("%d: expected run %d to publish: %v", i, j, test.expected[j])
+			}
+		}
+	}
+}
+
+func Test_ShouldPublishDelta(t *testing.T) {
+	state := new(jobState)
+	config := plugins.PluginConfig{Publish: publishDelta, Heartbeat: 10, Delta: 1}
+
+	runs := []struct {
+		value    string
+		expected bool
+	}{
+		{"10", true},
+		{"10.5", false},
+		{"10.9", false}, // compared with what was last sent, not the last run
+		{"11.5", true},
+		{"11", false},
+	}
+
+	for i, run := range runs {
+		if publish := state.shouldPublish(config, plugins.OK, map[string]string{"value": run.value}); run.expected != publish {
+			t.Errorf("%d: expected %s to publish: %v", i, run.value, run.expected)
+		}
+	}
+	if 3 != state.suppressed {
+		t.Errorf("expected 3 suppressed results, got %d", state.suppressed)
+	}
+}
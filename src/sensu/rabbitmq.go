@@ -15,7 +15,7 @@ type MessageQueuer interface {
 	Connect(connected chan bool)
 	Disconnected() chan *amqp.Error
 	ExchangeDeclare(name string, kind string) error
-	QueueDeclare(name string) (amqp.Queue, error)
+	QueueDeclare(name string, opts QueueOptions) (amqp.Queue, error)
 	QueueBind(name, key, source string) error
 	Consume(name, consumer string) (<-chan amqp.Delivery, error)
 	Publish(exchange string, key string, msg amqp.Publishing) error
@@ -30,6 +30,18 @@ type Rabbitmq struct {
 	connected    bool
 }
 
+// how a queue is declared. a queue that is not durable and not auto-delete
+// will still go away when RabbitMQ restarts, but lives through our reconnects
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	MessageTTL time.Duration // zero means messages never expire
+	MaxLength  int           // zero means no limit
+	Expires    time.Duration // how long the queue lives without a consumer, zero means forever
+
+	DeadLetterExchange string // rejected messages are republished here
+}
+
 // back off logic
 const rabbitmqRetryInterval = 2
 const rabbitmqRetryIntervalMax = 120
@@ -114,17 +126,40 @@ func (r *Rabbitmq) ExchangeDeclare(name, kind string) error {
 	)
 }
 
-func (r *Rabbitmq) QueueDeclare(name string) (amqp.Queue, error) {
+func (r *Rabbitmq) QueueDeclare(name string, opts QueueOptions) (amqp.Queue, error) {
 	return r.channel.QueueDeclare(
 		name,
-		false,
-		true,
+		opts.Durable,
+		opts.AutoDelete,
 		false,
 		false,
-		nil,
+		queueArgs(opts),
 	)
 }
 
+// turns our queue options into the x-arguments RabbitMQ understands. they are
+// sent as 64 bit integers, a ttl of a month does not fit in 32 bits of milliseconds
+func queueArgs(opts QueueOptions) amqp.Table {
+	args := amqp.Table{}
+	if opts.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(opts.MessageTTL / time.Millisecond)
+	}
+	if opts.MaxLength > 0 {
+		args["x-max-length"] = int64(opts.MaxLength)
+	}
+	if opts.Expires > 0 {
+		args["x-expires"] = int64(opts.Expires / time.Millisecond)
+	}
+	if "" != opts.DeadLetterExchange {
+		args["x-dead-letter-exchange"] = opts.DeadLetterExchange
+	}
+
+	if 0 == len(args) {
+		return nil
+	}
+	return args
+}
+
 func (r *Rabbitmq) QueueBind(name, key, source string) error {
 	return r.channel.QueueBind(
 		name,
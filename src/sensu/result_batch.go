@@ -0,0 +1,96 @@
+package sensu
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/streadway/amqp"
+)
+
+// results sent as a batch are wrapped in an envelope:
+//
+//	{"sensu_batch": 1, "count": 2, "results": [{"client": ..., "check": {...}}, {...}]}
+//
+// each entry in results is a result exactly as it would have been published on
+// its own. the message also carries the content type below and an
+// x-sensu-batch header with the count, so a server side extension can tell a
+// batch from a single result without parsing it. UnbatchResults splits them up
+const (
+	resultBatchVersion     = 1
+	resultBatchContentType = "application/vnd.sensu.batch+json"
+	resultBatchHeader      = "x-sensu-batch"
+)
+
+// how long a batch waits to fill up before it is sent anyway, in milliseconds
+const defaultBatchWait = 1000
+
+type resultEnvelope struct {
+	Version int               `json:"sensu_batch"`
+	Count   int               `json:"count"`
+	Results []json.RawMessage `json:"results"`
+}
+
+// collects results until there are enough of them to be worth a message
+type resultBatch struct {
+	size    int
+	results [][]byte
+}
+
+func newResultBatch(size int) *resultBatch {
+	return &resultBatch{size: size}
+}
+
+// adds a result, returning true once the batch is full
+func (b *resultBatch) Add(result []byte) bool {
+	b.results = append(b.results, result)
+	return len(b.results) >= b.size
+}
+
+func (b *resultBatch) Len() int {
+	return len(b.results)
+}
+
+// empties the batch, handing back what was in it
+func (b *resultBatch) Take() [][]byte {
+	results := b.results
+	b.results = nil
+	return results
+}
+
+func getBatchPayload(results [][]byte) (amqp.Publishing, error) {
+	envelope := resultEnvelope{Version: resultBatchVersion, Count: len(results)}
+	for _, result := range results {
+		envelope.Results = append(envelope.Results, json.RawMessage(result))
+	}
+
+	body, err := json.Marshal(envelope)
+	if nil != err {
+		return amqp.Publishing{}, err
+	}
+	return amqp.Publishing{
+		ContentType:  resultBatchContentType,
+		Headers:      amqp.Table{resultBatchHeader: int32(len(results))},
+		Body:         body,
+		DeliveryMode: amqp.Transient,
+	}, nil
+}
+
+// splits a message from the results queue back into the results it holds. a
+// message that isn't a batch is a single result and is handed back as it is
+func UnbatchResults(body []byte) ([][]byte, error) {
+	var envelope resultEnvelope
+	if err := json.Unmarshal(body, &envelope); nil != err || 0 == envelope.Version {
+		return [][]byte{body}, nil
+	}
+	if envelope.Version > resultBatchVersion {
+		return nil, fmt.Errorf("Unknown result batch version %d", envelope.Version)
+	}
+	if envelope.Count != len(envelope.Results) {
+		return nil, fmt.Errorf("Result batch claims %d results but holds %d", envelope.Count, len(envelope.Results))
+	}
+
+	results := make([][]byte, len(envelope.Results))
+	for i, result := range envelope.Results {
+		results[i] = []byte(result)
+	}
+	return results, nil
+}
@@ -0,0 +1,158 @@
+package sensu
+
+import (
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"math"
+	"os"
+	"sync"
+	"testing"
+)
+
+// a queue that remembers what was published, failing when asked to
+type testQueue struct {
+	lock      sync.Mutex
+	published []amqp.Publishing
+	fail      bool
+}
+
+func (q *testQueue) Connect(connected chan bool)                    {}
+func (q *testQueue) Disconnected() chan *amqp.Error                 { return nil }
+func (q *testQueue) ExchangeDeclare(name string, kind string) error { return nil }
+func (q *testQueue) QueueDeclare(name string, opts QueueOptions) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+func (q *testQueue) QueueBind(name, key, source string) error { return nil }
+func (q *testQueue) Consume(name, consumer string) (<-chan amqp.Delivery, error) {
+	return nil, nil
+}
+
+func (q *testQueue) Publish(exchange string, key string, msg amqp.Publishing) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.fail {
+		return errors.New("connection lost")
+	}
+	q.published = append(q.published, msg)
+	return nil
+}
+
+func Test_UnbatchResults(t *testing.T) {
+	results := [][]byte{[]byte(`{"client":"a"}`), []byte(`{"client":"b"}`)}
+	payload, err := getBatchPayload(results)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if resultBatchContentType != payload.ContentType || int32(2) != payload.Headers[resultBatchHeader] {
+		t.Errorf("expected the batch to be marked as one: %+v", payload)
+	}
+
+	unbatched, err := UnbatchResults(payload.Body)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 2 != len(unbatched) || `{"client":"b"}` != string(unbatched[1]) {
+		t.Errorf("unexpected results: %q", unbatched)
+	}
+
+	single := []byte(`{"client":"a","check":{"name":"cpu_metrics"}}`)
+	if unbatched, _ = UnbatchResults(single); 1 != len(unbatched) || string(single) != string(unbatched[0]) {
+		t.Errorf("expected a single result to be handed back as it is, got %q", unbatched)
+	}
+
+	if _, err = UnbatchResults([]byte(`{"sensu_batch":1,"count":3,"results":[{}]}`)); nil == err {
+		t.Error("expected a short batch to be refused")
+	}
+}
+
+func Test_ReplayResultsBatched(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p := newTestProcessor(t)
+	p.config.Results.BatchSize = 4
+	p.store = newTestStatStore(t, dir, StatStoreConfig{})
+	defer p.store.Close()
+	for i := 0; i < 10; i++ {
+		p.store.Append([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+
+	q := &testQueue{fail: true}
+	p.q = q
+	p.replayResults(math.MaxInt32)
+	if 0 != len(q.published) {
+		t.Fatal("expected nothing to be published")
+	}
+
+	// nothing was lost by the failed attempt
+	q.fail = false
+	p.replayResults(math.MaxInt32)
+	if 3 != len(q.published) {
+		t.Fatalf("expected 3 messages, got %d", len(q.published))
+	}
+
+	var replayed []string
+	for _, msg := range q.published {
+		results, err := UnbatchResults(msg.Body)
+		if nil != err {
+			t.Fatal(err)
+		}
+		for _, result := range results {
+			replayed = append(replayed, string(result))
+		}
+	}
+	if 10 != len(replayed) || `{"n":0}` != replayed[0] || `{"n":9}` != replayed[9] {
+		t.Errorf("expected every stored result once, in order, got %v", replayed)
+	}
+}
+
+func Test_ReplayResultsLimited(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	p := newTestProcessor(t)
+	p.config.Results.BatchSize = 4
+	p.store = newTestStatStore(t, dir, StatStoreConfig{})
+	defer p.store.Close()
+	for i := 0; i < 10; i++ {
+		p.store.Append([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	q := &testQueue{}
+	p.q = q
+
+	if sent, more := p.replayResults(6); 6 != sent || !more {
+		t.Errorf("expected 6 sent with more to come, got %d %v", sent, more)
+	}
+	if 2 != len(q.published) {
+		t.Errorf("expected a batch of 4 and a batch of 2, got %d messages", len(q.published))
+	}
+
+	// live results go first
+	p.results.Push(testSavedResult(`{"live":true}`))
+	if sent, more := p.replayResults(6); 0 != sent || !more {
+		t.Errorf("expected replay to wait for live results, got %d %v", sent, more)
+	}
+	p.results.Pop()
+
+	if sent, more := p.replayResults(6); 4 != sent || more {
+		t.Errorf("expected the last 4 with nothing more, got %d %v", sent, more)
+	}
+}
+
+func Test_ReplayLimit(t *testing.T) {
+	p := newTestProcessor(t)
+	var tests = []struct {
+		rate, limit int
+	}{
+		{0, math.MaxInt32},
+		{100, 10},
+		{5, 1},
+	}
+	for _, test := range tests {
+		p.config.Results.ReplayRate = test.rate
+		if limit := p.replayLimit(); test.limit != limit {
+			t.Errorf("expected a limit of %d for %d a second, got %d", test.limit, test.rate, limit)
+		}
+	}
+}
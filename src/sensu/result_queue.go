@@ -0,0 +1,233 @@
+package sensu
+
+import (
+	"sync"
+	"time"
+)
+
+// what the result queue does with a new result once it is full
+const (
+	overflowDropOldest = "drop_oldest" // make room by throwing away the oldest result
+	overflowDropNewest = "drop_newest" // throw away the new result
+	overflowSpill      = "spill"       // write the oldest result to the stat store to make room
+)
+
+const defaultResultQueueSize = 600
+
+// seconds between attempts at publishing the results that failed
+const defaultRetryInterval = 5
+
+// how often stored results are replayed, replay_rate is spread across these
+const replayTick = 100 * time.Millisecond
+
+// results are published in priority order: check results first, so an alert
+// never waits behind a backlog of metrics
+const (
+	priorityCheck = iota
+	priorityMetric
+	resultLanes
+)
+
+func resultPriority(result ResultInterface) int {
+	if r, ok := result.(*Result); ok && "metric" != r.Check.CheckType {
+		return priorityCheck
+	}
+	return priorityMetric
+}
+
+// the results waiting to be published. unlike a channel, adding to a full queue
+// never blocks, so a slow or missing RabbitMQ cannot hold up the scheduler
+type resultQueue struct {
+	lock     sync.Mutex
+	lanes    [resultLanes][]ResultInterface // oldest first within each lane
+	size     int
+	capacity int
+	overflow string
+	spill    func(ResultInterface) error // where spilled results go, nil when there is no stat store
+	ready    chan bool                   // signalled when results are added
+
+	dropped int // results thrown away because the queue was full
+	spilled int // results written to the stat store because the queue was full
+}
+
+func newResultQueue(capacity int, overflow string) *resultQueue {
+	q := &resultQueue{ready: make(chan bool, 1)}
+	q.configure(capacity, overflow)
+	return q
+}
+
+// changes the size and overflow policy, dropping the oldest results if the queue shrinks
+func (q *resultQueue) configure(capacity int, overflow string) {
+	q.lock.Lock()
+
+	if capacity <= 0 {
+		capacity = defaultResultQueueSize
+	}
+	if "" == overflow {
+		overflow = overflowDropOldest
+	}
+	q.capacity = capacity
+	q.overflow = overflow
+
+	var evicted []ResultInterface
+	for q.size > q.capacity {
+		if result := q.evict(); nil != result {
+			evicted = append(evicted, result)
+		}
+	}
+	spill := q.spill
+	q.lock.Unlock()
+
+	for _, result := range evicted {
+		q.spillResult(spill, result)
+	}
+}
+
+func (q *resultQueue) setSpill(spill func(ResultInterface) error) {
+	q.lock.Lock()
+	q.spill = spill
+	q.lock.Unlock()
+}
+
+// adds a result, making room as the overflow policy says when the queue is full
+func (q *resultQueue) Push(result ResultInterface) {
+	var evicted ResultInterface
+	q.lock.Lock()
+	if q.size >= q.capacity {
+		if overflowDropNewest == q.overflow {
+			q.dropped++
+			q.lock.Unlock()
+			return
+		}
+		evicted = q.evict()
+	}
+	lane := resultPriority(result)
+	q.lanes[lane] = append(q.lanes[lane], result)
+	q.size++
+	spill := q.spill
+	q.lock.Unlock()
+
+	if nil != evicted {
+		q.spillResult(spill, evicted)
+	}
+
+	select {
+	case q.ready <- true:
+	default:
+	}
+}
+
+// makes room for one more result, taking the oldest of the least important
+// results. it is returned when it is to be spilled, otherwise it is dropped.
+// the caller holds the lock
+func (q *resultQueue) evict() ResultInterface {
+	for lane := resultLanes - 1; lane >= 0; lane-- {
+		if 0 == len(q.lanes[lane]) {
+			continue
+		}
+		oldest := q.take(lane)
+
+		if overflowSpill == q.overflow && nil != q.spill {
+			return oldest
+		}
+		q.dropped++
+		return nil
+	}
+	return nil
+}
+
+// writes an evicted result to the stat store. that is disk I/O, so the caller
+// must not hold the lock or everyone pushing and popping would wait on the disk
+func (q *resultQueue) spillResult(spill func(ResultInterface) error, result ResultInterface) {
+	err := spill(result)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if nil == err {
+		q.spilled++
+	} else {
+		q.dropped++
+	}
+}
+
+// takes the oldest result off a lane. the caller holds the lock
+func (q *resultQueue) take(lane int) ResultInterface {
+	result := q.lanes[lane][0]
+	q.lanes[lane][0] = nil
+	q.lanes[lane] = q.lanes[lane][1:]
+	q.size--
+	return result
+}
+
+// takes the most important result off the queue, false when it is empty
+func (q *resultQueue) Pop() (ResultInterface, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for lane := range q.lanes {
+		if len(q.lanes[lane]) > 0 {
+			return q.take(lane), true
+		}
+	}
+	return nil, false
+}
+
+// the result Pop would return without taking it off the queue, for retrying in order
+func (q *resultQueue) Peek() (ResultInterface, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for lane := range q.lanes {
+		if len(q.lanes[lane]) > 0 {
+			return q.lanes[lane][0], true
+		}
+	}
+	return nil, false
+}
+
+// takes a result we peeked at off the queue, unless it has already been pushed off the end
+func (q *resultQueue) Remove(result ResultInterface) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	lane := resultPriority(result)
+	if len(q.lanes[lane]) > 0 && q.lanes[lane][0] == result {
+		q.take(lane)
+	}
+}
+
+// signalled when there may be results to Pop
+func (q *resultQueue) Ready() <-chan bool {
+	return q.ready
+}
+
+func (q *resultQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// how full the queue is and what it has had to throw away
+type ResultQueueStats struct {
+	Depth    int    `json:"depth"`
+	Checks   int    `json:"checks"`  // check results waiting
+	Metrics  int    `json:"metrics"` // metric and other results waiting
+	Capacity int    `json:"capacity"`
+	Overflow string `json:"overflow"`
+	Dropped  int    `json:"dropped"`
+	Spilled  int    `json:"spilled"`
+}
+
+func (q *resultQueue) Stats() ResultQueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return ResultQueueStats{
+		Depth:    q.size,
+		Checks:   len(q.lanes[priorityCheck]),
+		Metrics:  len(q.lanes[priorityMetric]),
+		Capacity: q.capacity,
+		Overflow: q.overflow,
+		Dropped:  q.dropped,
+		Spilled:  q.spilled,
+	}
+}
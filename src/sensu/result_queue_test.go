@@ -0,0 +1,169 @@
+package sensu
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testSavedResult(body string) *SavedResult {
+	sr := new(SavedResult)
+	sr.SetResult(body)
+	return sr
+}
+
+func queueBodies(q *resultQueue) []string {
+	var bodies []string
+	for {
+		result, ok := q.Pop()
+		if !ok {
+			return bodies
+		}
+		bodies = append(bodies, string(result.toJson()))
+	}
+}
+
+func Test_ResultQueueOverflow(t *testing.T) {
+	var tests = []struct {
+		overflow string
+		kept     []string
+		dropped  int
+	}{
+		{overflowDropOldest, []string{"b", "c"}, 1},
+		{overflowDropNewest, []string{"a", "b"}, 1},
+		{overflowSpill, []string{"b", "c"}, 0},
+	}
+
+	for _, test := range tests {
+		var spilled []string
+		q := newResultQueue(2, test.overflow)
+		q.setSpill(func(r ResultInterface) error {
+			spilled = append(spilled, string(r.toJson()))
+			return nil
+		})
+
+		for _, body := range []string{"a", "b", "c"} {
+			q.Push(testSavedResult(body))
+		}
+
+		stats := q.Stats()
+		if test.dropped != stats.Dropped {
+			t.Errorf("%s: expected %d dropped, got %d", test.overflow, test.dropped, stats.Dropped)
+		}
+		if overflowSpill == test.overflow && (1 != stats.Spilled || 1 != len(spilled) || "a" != spilled[0]) {
+			t.Errorf("%s: expected the oldest result to be spilled, got %v", test.overflow, spilled)
+		}
+		if kept := queueBodies(q); len(test.kept) != len(kept) || test.kept[0] != kept[0] || test.kept[1] != kept[1] {
+			t.Errorf("%s: expected %v to be kept, got %v", test.overflow, test.kept, kept)
+		}
+	}
+}
+
+func Test_ResultQueueSpillFailure(t *testing.T) {
+	q := newResultQueue(1, overflowSpill)
+	q.setSpill(func(r ResultInterface) error { return errors.New("disk full") })
+	q.Push(testSavedResult("a"))
+	q.Push(testSavedResult("b"))
+
+	if stats := q.Stats(); 1 != stats.Dropped || 0 != stats.Spilled {
+		t.Errorf("expected a result that cannot be spilled to be dropped: %+v", stats)
+	}
+}
+
+func Test_ResultQueueShrink(t *testing.T) {
+	q := newResultQueue(5, overflowDropOldest)
+	for _, body := range []string{"a", "b", "c", "d"} {
+		q.Push(testSavedResult(body))
+	}
+	q.configure(2, overflowDropOldest)
+
+	if kept := queueBodies(q); 2 != len(kept) || "c" != kept[0] {
+		t.Errorf("expected the newest results to be kept, got %v", kept)
+	}
+}
+
+func Test_PublishRetries(t *testing.T) {
+	p := newTestProcessor(t)
+	q := &testQueue{fail: true}
+	p.q = q
+
+	p.publishResult(testSavedResult("a"))
+	p.publishResult(testSavedResult("b"))
+	p.publishRetries()
+	if 2 != p.retry.Len() {
+		t.Fatalf("expected 2 results waiting to be retried, got %d", p.retry.Len())
+	}
+
+	q.fail = false
+	p.publishRetries()
+	if 0 != p.retry.Len() || 2 != len(q.published) {
+		t.Fatalf("expected the retries to be published, %d left", p.retry.Len())
+	}
+	if "a" != string(q.published[0].Body) || "b" != string(q.published[1].Body) {
+		t.Errorf("expected the retries in order, got %q then %q", q.published[0].Body, q.published[1].Body)
+	}
+}
+
+func Test_ResultQueuePriority(t *testing.T) {
+	check := NewResult(ClientConfig{Name: "test"}, "check")
+	check.SetType("check")
+
+	q := newResultQueue(3, overflowDropOldest)
+	q.Push(testSavedResult("a"))
+	q.Push(testSavedResult("b"))
+	q.Push(check)
+
+	if stats := q.Stats(); 1 != stats.Checks || 2 != stats.Metrics {
+		t.Errorf("expected 1 check and 2 metrics waiting, got %+v", stats)
+	}
+	if result, _ := q.Peek(); result != check {
+		t.Error("expected the check result to be next")
+	}
+
+	// a full queue throws away metrics before checks
+	q.Push(testSavedResult("c"))
+	result, _ := q.Pop()
+	if result != check {
+		t.Fatal("expected the check result to be kept and published first")
+	}
+	if bodies := queueBodies(q); 2 != len(bodies) || "b" != bodies[0] || "c" != bodies[1] {
+		t.Errorf("expected the oldest metric to be dropped, got %v", bodies)
+	}
+}
+
+// a slow disk holds up the result being spilled, not everyone using the queue
+func Test_ResultQueueSpillsOutsideTheLock(t *testing.T) {
+	q := newResultQueue(1, overflowSpill)
+	spilling := make(chan bool)
+	release := make(chan bool)
+	q.setSpill(func(r ResultInterface) error {
+		spilling <- true
+		<-release
+		return nil
+	})
+
+	q.Push(testSavedResult("a"))
+	pushed := make(chan bool)
+	go func() {
+		q.Push(testSavedResult("b"))
+		close(pushed)
+	}()
+	<-spilling
+
+	popped := make(chan bool)
+	go func() {
+		q.Pop()
+		close(popped)
+	}()
+	select {
+	case <-popped:
+	case <-time.After(time.Second):
+		t.Error("expected to pop while a result is being spilled")
+	}
+
+	close(release)
+	<-pushed
+	if stats := q.Stats(); 1 != stats.Spilled {
+		t.Errorf("expected the result to be spilled once the disk caught up: %+v", stats)
+	}
+}
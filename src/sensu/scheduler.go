@@ -0,0 +1,322 @@
+package sensu
+
+import (
+	"plugins"
+	"time"
+)
+
+// what to do when a job is due while its previous run is still going
+const (
+	overlapSkip  = "skip"  // drop the run, we will catch the next one
+	overlapDelay = "delay" // run as soon as the previous run finishes
+)
+
+// a run that starts this much later than it was due counts as late
+const jobLateThreshold = time.Second
+
+// runs a job on its schedule until the processor is stopped. the timer is
+// re-armed when it fires, so a slow run does not push the schedule back
+func (p *PluginProcessor) scheduleJob(name string, job plugins.SensuPluginInterface) {
+	config, sched, _ := p.jobConfig(name)
+	state := p.jobState(name)
+
+	fire := make(chan bool, 1)
+	done := make(chan error, 1)
+
+	// cron jobs wait for their time. interval jobs spread their first run out over
+	// the interval so that a fleet of clients started at the same time do not all
+	// report in the same second
+	var first time.Duration
+	if interval, ok := sched.(intervalSchedule); ok {
+		if config.Splay {
+			first = splayDelay(p.config.Client.Name, name, interval.interval, p.splayCoverage(config), time.Now())
+			p.logger.Printf("Splaying %s by %s", name, first)
+		}
+	} else if next, ok := p.untilNextRun(name, sched); ok {
+		first = next
+	} else {
+		<-p.close
+		return
+	}
+
+	due := time.Now().Add(first)
+	state.setNextRun(due)
+	timer := time.AfterFunc(first, func() {
+		select {
+		case fire <- true:
+		default:
+		}
+	})
+	defer timer.Stop()
+
+	// arms the timer for the next run
+	rearm := func(next time.Duration) {
+		due = time.Now().Add(next)
+		state.setNextRun(due)
+		timer.Reset(next)
+	}
+
+	var running, pending bool
+	var pendingDue time.Time
+
+	// starts a run unless the previous one is still going
+	start := func(scheduled time.Time) {
+		if running {
+			if overlapDelay == config.Overlap && !pending {
+				pending, pendingDue = true, scheduled
+				p.logger.Printf("Delaying %s, the previous run is still going", name)
+			} else {
+				count := state.countSkipped()
+				p.logger.Printf("Skipping %s, the previous run is still going (%d runs skipped)", name, count)
+			}
+			return
+		}
+
+		running = true
+		p.inFlight.Add(1)
+		go p.runScheduledJob(name, job, config, state, scheduled, done)
+	}
+
+	for {
+		select {
+		case <-fire:
+			scheduled := due
+			// no run means no done to re-arm a job that is backing off, so
+			// paused jobs are always re-armed here
+			if state.isPaused() {
+				p.logger.Printf("Paused: %s", name)
+				if next, ok := p.untilNextRun(name, sched); ok {
+					rearm(next)
+				}
+				continue
+			}
+
+			// a job that is backing off is re-armed once its run finishes
+			if 0 == state.failureCount() {
+				if next, ok := p.untilNextRun(name, sched); ok {
+					rearm(next)
+				}
+			}
+			start(scheduled)
+
+		case <-state.trigger: // someone asked for a run right now
+			p.logger.Printf("Triggered: %s", name)
+			start(time.Now())
+
+		case err := <-done:
+			running = false
+			if nil != err {
+				failures := state.fail(err)
+				if next, ok := p.untilNextRun(name, sched); ok {
+					rearm(p.backoff(name, config, failures, sched, next))
+				}
+			} else if failures := state.recover(); failures > 0 {
+				p.logger.Printf("%s recovered after %d failures", name, failures)
+				if next, ok := p.untilNextRun(name, sched); ok {
+					rearm(next)
+				}
+			}
+
+			if pending {
+				pending = false
+				running = true
+				p.inFlight.Add(1)
+				go p.runScheduledJob(name, job, config, state, pendingDue, done)
+			}
+
+		case <-p.close: // shutting down stats gather message
+			return
+		}
+	}
+}
+
+// waits for a free slot when the number of concurrent checks is capped, then
+// runs the job and lets the scheduler know how it went
+func (p *PluginProcessor) runScheduledJob(name string, job plugins.SensuPluginInterface, config plugins.PluginConfig, state *jobState, scheduled time.Time, done chan error) {
+	defer p.inFlight.Done()
+	if nil != p.slots {
+		p.slots <- true
+		defer func() { <-p.slots }()
+	}
+
+	state.setLastRun(time.Now())
+	if late := time.Since(scheduled); late > jobLateThreshold {
+		count := state.countLate()
+		p.logger.Printf("%s started %s late (%d late runs)", name, late, count)
+	}
+
+	done <- p.runJob(name, job, config)
+}
+
+// a single run of a job, from gathering through to queueing the result
+func (p *PluginProcessor) runJob(name string, job plugins.SensuPluginInterface, config plugins.PluginConfig) error {
+	clientConfig := p.config.Client
+
+	if isSubdued, err := checkSubdued(config, clientConfig); nil != err {
+		p.logger.Printf("Ignoring subdue for %s: %s", name, err)
+	} else if isSubdued {
+		count := p.jobState(name).countSubdued()
+		p.counters.countSubduedRun()
+		p.logger.Printf("Subdued: %s (%d runs subdued)", name, count)
+		return nil
+	}
+
+	if dependency, status, failing := p.failedDependency(name, config); failing {
+		count := p.jobState(name).countDependent()
+		p.logger.Printf("Skipping %s, %s is %s (%d runs skipped)", name, dependency, status.ToString(), count)
+		// a report is held back and suppressed just as the check's own results
+		// are, but it stays out of the check's history
+		if dependencyReport == config.DependencyAction {
+			state := p.jobState(name)
+			occurrences := state.recordDependencyReport()
+			if !p.holdBack(name, config, state, plugins.UNKNOWN, occurrences) && p.shouldPublish(name, config, state, plugins.UNKNOWN, nil) {
+				p.results.Push(newDependencyResult(clientConfig, name, config, dependency, status))
+			}
+		}
+		return nil
+	}
+
+	p.logger.Printf("Gathering: %s", name)
+	result := NewResult(clientConfig, name)
+	result.SetCheckConfig(config)
+	result.SetMetricPrefix(p.prefixes.metricPrefix(p.config, config, p.logger))
+
+	plugin_result := new(plugins.Result)
+
+	err := job.Gather(plugin_result)
+	status := result.SetGathered(job.GetStatus(), config, plugin_result)
+	if result.Truncated() {
+		count := p.counters.countTruncated()
+		if "" == result.Check.Output {
+			p.logger.Printf("Dropped all the output of %s, its first line is over the max_output_size of %d bytes (%d results truncated)", name, result.maxOutputSize, count)
+		} else {
+			p.logger.Printf("Truncated the output of %s (%d results truncated)", name, count)
+		}
+	}
+	if nil == err && nil != p.exporter {
+		p.exporter.Update(name, plugin_result.Output())
+	}
+	if nil != err {
+		// returned an error - let the server know and back off before trying again
+		p.logger.Printf("Failed to gather stat: %s. %v", name, err)
+		result = newErrorResult(clientConfig, name, config, err)
+		status = plugins.UNKNOWN
+	}
+
+	state := p.jobState(name)
+	history, flapping, occurrences := state.record(status, config.LowFlapThreshold, config.HighFlapThreshold)
+	result.SetHistory(history, flapping)
+	if p.holdBack(name, config, state, status, occurrences) {
+		return err
+	}
+
+	// diagnostics are gathered when a check changes status, or once a failure is reported
+	reportAt := config.Occurrences
+	if reportAt < 1 || plugins.OK == status {
+		reportAt = 1
+	}
+	if occurrences == reportAt {
+		if hook, ok := result.runHooks(config.Hooks, status); ok {
+			p.logger.Printf("Ran the %s hook for %s, exit status %d", hook.Name, name, hook.Status)
+		}
+	}
+
+	var values map[string]string
+	if publishDelta == config.Publish {
+		values = metricValues(plugin_result.Output())
+	}
+	if !p.shouldPublish(name, config, state, status, values) {
+		return err
+	}
+
+	// metrics can go straight to carbon instead of, or as well as, RabbitMQ
+	if "metric" == result.Check.CheckType && (routeCarbon == config.Route || routeBoth == config.Route) {
+		if p.sendToCarbon(carbonLines(result, plugin_result.Output())) {
+			if routeCarbon == config.Route {
+				return err
+			}
+		} else if routeCarbon == config.Route {
+			p.logger.Printf("%s is routed to carbon, but there is no carbon server. Sending it to RabbitMQ", name)
+		}
+	}
+
+	// add it to the processing queue
+	p.results.Push(result)
+	return err
+}
+
+// hold back failures until they have happened often enough to be worth telling anyone about
+func (p *PluginProcessor) holdBack(name string, config plugins.PluginConfig, state *jobState, status plugins.Status, occurrences int) bool {
+	if plugins.OK != status && occurrences < config.Occurrences {
+		count := state.countHeld()
+		p.logger.Printf("Holding back %s %s, %d of %d occurrences (%d results held)", name, status.ToString(), occurrences, config.Occurrences, count)
+		return true
+	}
+	return false
+}
+
+// on metered links there is no point paying to tell the server nothing has changed
+func (p *PluginProcessor) shouldPublish(name string, config plugins.PluginConfig, state *jobState, status plugins.Status, values map[string]string) bool {
+	if !state.shouldPublish(config, status, values) {
+		p.logger.Printf("Not publishing %s, nothing has changed", name)
+		return false
+	}
+	return true
+}
+
+// how long until the job next runs. false when the schedule never fires again
+func (p *PluginProcessor) untilNextRun(name string, sched schedule) (time.Duration, bool) {
+	now := time.Now()
+	next := sched.Next(now)
+	if next.IsZero() {
+		p.logger.Printf("%s will never run again", name)
+		return 0, false
+	}
+
+	if _, ok := sched.(*cronSchedule); ok {
+		p.logger.Printf("Next run of %s at %s", name, next.Format(time.RFC1123))
+	}
+	return next.Sub(now), true
+}
+
+// interval jobs that keep failing wait twice as long after each failure, up to
+// a ceiling. cron jobs just wait for their next run
+func (p *PluginProcessor) backoff(name string, config plugins.PluginConfig, failures int, sched schedule, next time.Duration) time.Duration {
+	interval, ok := sched.(intervalSchedule)
+	if !ok {
+		return next
+	}
+
+	ceiling := jobRetryIntervalMax * time.Second
+	if config.BackoffMax > 0 {
+		ceiling = config.BackoffMax * time.Second
+	}
+
+	delay := jobBackoff(interval.interval, failures, ceiling)
+	p.logger.Printf("%s has failed %d times, retrying in %s", name, failures, delay)
+	return delay
+}
+
+// doubles the interval for each failure after the first, without going over the ceiling
+func jobBackoff(interval time.Duration, failures int, ceiling time.Duration) time.Duration {
+	if ceiling < interval {
+		ceiling = interval
+	}
+
+	delay := interval
+	for i := 1; i < failures && delay < ceiling; i++ {
+		delay *= 2
+	}
+	if delay > ceiling {
+		delay = ceiling
+	}
+	return delay
+}
+
+// the percentage of the interval our splay may use. the check can override the client
+func (p *PluginProcessor) splayCoverage(config plugins.PluginConfig) int {
+	if config.SplayCoverage > 0 {
+		return config.SplayCoverage
+	}
+	return p.config.Client.SplayCoverage
+}
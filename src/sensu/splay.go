@@ -0,0 +1,37 @@
+package sensu
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// the percentage of the interval a check may be splayed over, as in Sensu Go
+const defaultSplayCoverage = 90
+
+// Sensu style splay. each check gets an offset within its interval from a
+// hash of the client and check names. the offset is lined up against the
+// wall clock, so a client keeps the same schedule across restarts while a
+// fleet that restarts together spreads its checks out over the interval
+func splayDelay(clientName, checkName string, interval time.Duration, coverage int, now time.Time) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	if coverage <= 0 || coverage > 100 {
+		coverage = defaultSplayCoverage
+	}
+
+	window := int64(interval) / 100 * int64(coverage)
+	if window <= 0 {
+		return 0
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(clientName + ":" + checkName))
+	offset := int64(hash.Sum64() % uint64(window))
+
+	delay := (offset - now.UnixNano()) % int64(interval)
+	if delay < 0 {
+		delay += int64(interval)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,42 @@
+package sensu
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_SplayDelay(t *testing.T) {
+	interval := 60 * time.Second
+	now := time.Unix(1400000000, 0)
+
+	first := splayDelay("client-1", "cpu_metrics", interval, 0, now)
+	if first < 0 || first >= interval {
+		t.Errorf("expected the splay to fall within the interval, got %s", first)
+	}
+
+	if again := splayDelay("client-1", "cpu_metrics", interval, 0, now); again != first {
+		t.Errorf("expected a stable splay, got %s and %s", first, again)
+	}
+
+	// a second later we are a second closer to our run
+	if later := splayDelay("client-1", "cpu_metrics", interval, 0, now.Add(time.Second)); later != first-time.Second && first >= time.Second {
+		t.Errorf("expected the splay to follow the wall clock, got %s then %s", first, later)
+	}
+
+	if 0 != splayDelay("client-1", "cpu_metrics", 0, 0, now) {
+		t.Error("expected no splay without an interval")
+	}
+}
+
+func Test_SplayCoverage(t *testing.T) {
+	interval := 100 * time.Second
+	// at the top of an interval the delay is the offset, which must be inside the coverage window
+	now := time.Unix(1400000000, 0)
+
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		delay := splayDelay("client", name, interval, 10, now)
+		if delay >= 10*time.Second {
+			t.Errorf("expected %s to be splayed within the first 10%% of the interval, got %s", name, delay)
+		}
+	}
+}
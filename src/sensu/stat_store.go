@@ -0,0 +1,635 @@
+package sensu
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// when the stat store makes sure what it has written is on disk
+const (
+	statStoreFsyncAlways   = "always"   // after every result, the safest and the slowest
+	statStoreFsyncInterval = "interval" // every fsync_interval seconds
+	statStoreFsyncNever    = "never"    // whenever the OS gets around to it
+)
+
+const (
+	statStoreSegmentSize = 8 * 1024 * 1024   // bytes written to a segment before we start the next
+	statStoreMaxSize     = 100 * 1024 * 1024 // bytes we keep before dropping the oldest results
+	statStoreSyncSeconds = 1                 // seconds between syncs with the interval policy
+	statStoreCursorEvery = 100               // replayed results between saves of the cursor
+	statStoreMaxRecord   = 64 * 1024 * 1024  // anything claiming to be bigger than this is garbage
+
+	statStoreFrameHeader = 8 // length and checksum of each record
+	statStoreCursorFile  = "cursor"
+)
+
+var errStatStoreCorrupt = errors.New("corrupt record")
+
+var errStatStoreClosed = errors.New("Stat store: closed")
+
+var statStoreCrc = crc32.MakeTable(crc32.Castagnoli)
+
+// where a record starts in the store
+type walPosition struct {
+	segment uint64
+	offset  int64
+}
+
+// an append-only log of the results we could not send, kept in numbered
+// segment files. each record is framed as
+//
+//	| length uint32 | crc32c of the payload uint32 | payload |
+//
+// the cursor file remembers the first record that has not been replayed yet.
+// it only moves on once a result has been published, so a crash part way
+// through a replay sends some results twice rather than losing them
+type statStore struct {
+	dir     string
+	config  StatStoreConfig
+	logger  *log.Logger
+	lock    sync.Mutex
+	sealing sync.WaitGroup // segments being compressed in the background
+
+	active     *os.File // the segment we are appending to
+	activeSeq  uint64
+	activeSize int64
+	dirty      bool // written to since the last fsync
+
+	sealed     []segmentInfo // the segments before the active one, oldest first
+	sealedSize int64         // their bytes on disk, so retention needs no scan
+
+	reader    segmentReader // the segment we are replaying from
+	readerSeq uint64
+
+	cursor      walPosition // the first result that has not been published
+	read        walPosition // the next result Next hands out
+	uncommitted int         // records replayed since the cursor was last saved
+	closed      bool
+}
+
+// what retention needs to know about a segment we are done writing to
+type segmentInfo struct {
+	seq     uint64
+	size    int64
+	modTime time.Time
+}
+
+// opens the store in dir, creating it if need be. a record left half written
+// by a crash is cut off the end of the last segment
+func openStatStore(dir string, config StatStoreConfig, logger *log.Logger) (*statStore, error) {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, fmt.Errorf("Stat store: %s", err)
+	}
+
+	s := &statStore{dir: dir, config: config, logger: logger}
+	s.setDefaults()
+
+	// segments sealed from here on wait until we know what is in the store
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	segments, err := s.segments()
+	if nil != err {
+		return nil, err
+	}
+
+	if codec := s.codec(); nil == codec && "" != config.Compression && "none" != config.Compression {
+		logger.Printf("Unknown stat store compression %q, segments will not be compressed", config.Compression)
+	}
+
+	// only the last segment can have been written to when we stopped. a crash
+	// may have left a sealed one both compressed and not
+	for i, seq := range segments {
+		if _, codec := s.segmentFile(seq); nil != codec {
+			os.Remove(s.segmentPath(seq))
+		} else if i < len(segments)-1 {
+			s.sealLater(seq)
+		} else {
+			s.activeSeq = seq
+		}
+	}
+
+	if 0 == s.activeSeq {
+		s.activeSeq = 1
+		if len(segments) > 0 {
+			s.activeSeq = segments[len(segments)-1] + 1
+		}
+	} else if err = s.recover(s.activeSeq); nil != err {
+		return nil, err
+	}
+
+	if s.active, err = os.OpenFile(s.segmentPath(s.activeSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); nil != err {
+		return nil, fmt.Errorf("Stat store: %s", err)
+	}
+	if info, err := s.active.Stat(); nil == err {
+		s.activeSize = info.Size()
+	}
+
+	s.loadCursor(segments)
+	s.scanSegments()
+	s.enforceRetention()
+	return s, nil
+}
+
+func (s *statStore) setDefaults() {
+	if "" == s.config.Fsync {
+		s.config.Fsync = statStoreFsyncInterval
+	}
+	if s.config.FsyncInterval <= 0 {
+		s.config.FsyncInterval = statStoreSyncSeconds
+	}
+	if s.config.MaxSize <= 0 {
+		s.config.MaxSize = statStoreMaxSize
+	}
+	if s.config.SegmentSize <= 0 {
+		s.config.SegmentSize = statStoreSegmentSize
+	}
+	// we can only drop whole segments, so keep a few of them within the limit
+	if s.config.SegmentSize > s.config.MaxSize/4 {
+		s.config.SegmentSize = s.config.MaxSize / 4
+	}
+}
+
+func (s *statStore) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%010d.wal", seq))
+}
+
+// the sequence numbers of our segments, oldest first
+func (s *statStore) segments() ([]uint64, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if nil != err {
+		return nil, fmt.Errorf("Stat store: %s", err)
+	}
+
+	var segments []uint64
+	seen := make(map[uint64]bool)
+	for _, f := range files {
+		if name, ok := unknownCompression(f.Name()); ok {
+			return nil, fmt.Errorf("Stat store: %s is compressed with %s, which this build cannot read. Build with -tags %s or move it out of %s", f.Name(), name, name, s.dir)
+		}
+		if seq, _, ok := parseSegmentName(f.Name()); ok && !seen[seq] {
+			seen[seq] = true
+			segments = append(segments, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// finds the last good record in a segment and cuts off anything after it
+func (s *statStore) recover(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0600)
+	if nil != err {
+		return fmt.Errorf("Stat store: %s", err)
+	}
+	defer f.Close()
+
+	var offset int64
+	for {
+		payload, err := readFrame(f, offset)
+		if nil != err {
+			if io.EOF != err {
+				s.logger.Printf("Truncating a torn record at %d in %s: %v", offset, s.segmentPath(seq), err)
+				return f.Truncate(offset)
+			}
+			return nil
+		}
+		offset += statStoreFrameHeader + int64(len(payload))
+	}
+}
+
+// reads the record at offset. io.EOF when there is nothing there
+func readFrame(r io.ReaderAt, offset int64) ([]byte, error) {
+	header := make([]byte, statStoreFrameHeader)
+	n, err := r.ReadAt(header, offset)
+	if 0 == n && io.EOF == err {
+		return nil, io.EOF
+	}
+	if n < statStoreFrameHeader {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > statStoreMaxRecord {
+		return nil, errStatStoreCorrupt
+	}
+
+	payload := make([]byte, length)
+	if n, err = r.ReadAt(payload, offset+statStoreFrameHeader); n < int(length) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, statStoreCrc) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errStatStoreCorrupt
+	}
+	return payload, nil
+}
+
+func frame(payload []byte) []byte {
+	buf := make([]byte, statStoreFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, statStoreCrc))
+	copy(buf[statStoreFrameHeader:], payload)
+	return buf
+}
+
+// adds a result to the end of the store
+func (s *statStore) Append(payload []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errStatStoreClosed
+	}
+
+	record := frame(payload)
+	if s.activeSize > 0 && s.activeSize+int64(len(record)) > s.config.SegmentSize {
+		if err := s.rotate(); nil != err {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(record); nil != err {
+		// don't leave half a record behind for the next one to be written after
+		s.active.Truncate(s.activeSize)
+		return fmt.Errorf("Stat store: %s", err)
+	}
+	s.activeSize += int64(len(record))
+	s.dirty = true
+
+	if statStoreFsyncAlways == s.config.Fsync {
+		s.sync()
+	}
+	s.enforceRetention()
+	return nil
+}
+
+// starts a new segment
+func (s *statStore) rotate() error {
+	s.sync()
+	s.active.Close()
+	s.sealed = append(s.sealed, segmentInfo{s.activeSeq, s.activeSize, time.Now()})
+	s.sealedSize += s.activeSize
+	s.sealLater(s.activeSeq)
+
+	active, err := os.OpenFile(s.segmentPath(s.activeSeq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return fmt.Errorf("Stat store: %s", err)
+	}
+	s.active = active
+	s.activeSeq++
+	s.activeSize = 0
+	return nil
+}
+
+// compresses a segment we are done writing to, when we have been asked to.
+// that takes a while, so it is done in the background rather than holding up
+// whoever is appending
+func (s *statStore) sealLater(seq uint64) {
+	codec := s.codec()
+	if nil == codec {
+		return
+	}
+
+	s.sealing.Add(1)
+	go func() {
+		defer s.sealing.Done()
+		if err := s.compressSegment(seq, codec); nil != err {
+			s.logger.Printf("Unable to compress %s, leaving it as it is: %v", s.segmentPath(seq), err)
+		}
+	}()
+}
+
+// waits for the segments being compressed
+func (s *statStore) waitForSeals() {
+	s.sealing.Wait()
+}
+
+// flushes what we have written out to disk, unless told never to
+func (s *statStore) Sync() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.sync()
+	}
+}
+
+func (s *statStore) sync() {
+	if !s.dirty || statStoreFsyncNever == s.config.Fsync {
+		return
+	}
+	if err := s.active.Sync(); nil != err {
+		s.logger.Printf("Failed to sync the stat store: %v", err)
+	}
+	s.dirty = false
+}
+
+// the next result to replay and where the one after it starts, to be handed
+// to Commit once the result has been published. each call moves on to the
+// next result, Rewind goes back to the cursor. io.EOF once we have caught up
+func (s *statStore) Next() ([]byte, walPosition, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, s.read, errStatStoreClosed
+	}
+
+	for {
+		if s.read.segment > s.activeSeq {
+			return nil, s.read, io.EOF
+		}
+
+		if nil == s.reader || s.readerSeq != s.read.segment {
+			if nil != s.reader {
+				s.reader.Close()
+				s.reader = nil
+			}
+			reader, err := s.openSegment(s.read.segment)
+			if nil != err {
+				if !os.IsNotExist(err) {
+					return nil, s.read, fmt.Errorf("Stat store: %s", err)
+				}
+				// dropped while we were away
+				s.nextSegment()
+				continue
+			}
+			s.reader, s.readerSeq = reader, s.read.segment
+		}
+
+		payload, err := readFrame(s.reader, s.read.offset)
+		if nil == err {
+			s.read = walPosition{s.read.segment, s.read.offset + statStoreFrameHeader + int64(len(payload))}
+			return payload, s.read, nil
+		}
+
+		if s.read.segment == s.activeSeq {
+			if io.EOF == err {
+				return nil, s.read, io.EOF
+			}
+			// new results go in a fresh segment so we can skip past the damage
+			if err := s.rotate(); nil != err {
+				return nil, s.read, err
+			}
+		}
+
+		// the end of an older segment, or a bad record in it. either way there is
+		// nothing more we can get out of it
+		if io.EOF != err {
+			s.logger.Printf("Skipping the rest of %s, %v at %d", s.segmentPath(s.read.segment), err, s.read.offset)
+		}
+		s.nextSegment()
+	}
+}
+
+// moves the cursor past a replayed result. segments the cursor has moved past are removed
+func (s *statStore) Commit(next walPosition) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errStatStoreClosed
+	}
+
+	moved := next.segment > s.cursor.segment
+	s.cursor = next
+	s.uncommitted++
+	if moved || s.uncommitted >= statStoreCursorEvery || statStoreFsyncAlways == s.config.Fsync {
+		err := s.saveCursor()
+		if moved {
+			s.removeBefore(next.segment)
+		}
+		return err
+	}
+	return nil
+}
+
+// goes back to the first result that has not been committed, after a failed publish
+func (s *statStore) Rewind() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.read = s.cursor
+}
+
+// saves the cursor and syncs, for when we are done replaying or shutting down
+func (s *statStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+
+	s.sync()
+	return s.saveCursor()
+}
+
+// flushes and lets go of the segments. the store cannot be used afterwards,
+// and once Close returns nothing is left writing to its directory, so another
+// store may be opened on it
+func (s *statStore) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.sync()
+	err := s.saveCursor()
+	if nil != s.reader {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.active.Close()
+	s.closed = true
+	s.lock.Unlock()
+
+	// nothing new is sealed once we are closed. a seal takes the lock to finish
+	s.waitForSeals()
+	return err
+}
+
+// the bytes held in the store, replayed or not
+func (s *statStore) Size() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sealedSize + s.activeSize
+}
+
+// moves on to the start of the next segment. when everything before it has
+// been committed the cursor comes too, and the segments behind it are removed
+func (s *statStore) nextSegment() {
+	if nil != s.reader {
+		s.reader.Close()
+		s.reader = nil
+	}
+
+	next := s.activeSeq
+	for _, segment := range s.sealed {
+		if segment.seq > s.read.segment {
+			next = segment.seq
+			break
+		}
+	}
+
+	caughtUp := s.read == s.cursor
+	s.read = walPosition{next, 0}
+	if caughtUp {
+		s.cursor = s.read
+		s.saveCursor()
+		s.removeBefore(next)
+	}
+}
+
+// removes the segments that have been replayed
+func (s *statStore) removeBefore(seq uint64) {
+	for len(s.sealed) > 0 && s.sealed[0].seq < seq {
+		s.removeSegment(s.sealed[0].seq)
+	}
+}
+
+// drops the oldest segments while the store is too big or they are too old. the
+// segment we are writing to is always kept
+func (s *statStore) enforceRetention() {
+	maxAge := time.Duration(s.config.MaxAge) * time.Second
+	for len(s.sealed) > 0 {
+		oldest := s.sealed[0]
+		tooOld := maxAge > 0 && time.Since(oldest.modTime) > maxAge
+		if s.sealedSize+s.activeSize <= s.config.MaxSize && !tooOld {
+			break
+		}
+
+		seq := oldest.seq
+		if seq >= s.cursor.segment {
+			s.logger.Printf("Dropping %d bytes of stored results from %s", oldest.size, s.segmentPath(seq))
+		}
+		if nil != s.reader && s.readerSeq == seq {
+			s.reader.Close()
+			s.reader = nil
+		}
+		s.removeSegment(seq)
+
+		if seq >= s.cursor.segment {
+			s.cursor = walPosition{seq + 1, 0}
+			s.saveCursor()
+		}
+		if seq >= s.read.segment {
+			s.read = walPosition{seq + 1, 0}
+		}
+	}
+}
+
+// looks up the size and age of the segments before the active one. this is
+// done when we open, after that the counts are kept as segments come and go
+func (s *statStore) scanSegments() {
+	segments, err := s.segments()
+	if nil != err {
+		return
+	}
+
+	s.sealed, s.sealedSize = nil, 0
+	for _, seq := range segments {
+		if seq >= s.activeSeq {
+			break
+		}
+		path, _ := s.segmentFile(seq)
+		if info, err := os.Stat(path); nil == err {
+			s.sealed = append(s.sealed, segmentInfo{seq, info.Size(), info.ModTime()})
+			s.sealedSize += info.Size()
+		}
+	}
+}
+
+// the cursor is written to a temporary file and renamed over the old one, so
+// that a crash leaves either the old cursor or the new one
+func (s *statStore) saveCursor() error {
+	s.uncommitted = 0
+
+	path := filepath.Join(s.dir, statStoreCursorFile)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if nil != err {
+		return fmt.Errorf("Stat store cursor: %s", err)
+	}
+	fmt.Fprintf(f, "%d %d\n", s.cursor.segment, s.cursor.offset)
+	if statStoreFsyncNever != s.config.Fsync {
+		f.Sync()
+	}
+	f.Close()
+
+	if err = os.Rename(path+".tmp", path); nil != err {
+		return fmt.Errorf("Stat store cursor: %s", err)
+	}
+	return nil
+}
+
+// without a cursor we replay everything we have
+func (s *statStore) loadCursor(segments []uint64) {
+	s.cursor = walPosition{s.activeSeq, 0}
+	if len(segments) > 0 {
+		s.cursor.segment = segments[0]
+	}
+
+	defer func() { s.read = s.cursor }()
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, statStoreCursorFile))
+	if nil != err {
+		return
+	}
+	var cursor walPosition
+	if _, err = fmt.Sscanf(string(data), "%d %d", &cursor.segment, &cursor.offset); nil != err {
+		s.logger.Printf("Ignoring a bad stat store cursor: %q", data)
+		return
+	}
+	if cursor.segment >= s.cursor.segment {
+		s.cursor = cursor
+	}
+	// a torn record was cut off after the cursor was saved
+	if s.cursor.segment == s.activeSeq && s.cursor.offset > s.activeSize {
+		s.cursor.offset = s.activeSize
+	}
+}
+
+// moves the results from the newline delimited json file we used to use into
+// the store, then removes the file
+func (s *statStore) importLegacy(path string) error {
+	f, err := os.Open(path)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if info, err := f.Stat(); nil != err || info.IsDir() {
+		return err
+	}
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), statStoreMaxRecord)
+	for scanner.Scan() {
+		if 0 == len(strings.TrimSpace(scanner.Text())) {
+			continue
+		}
+		if err = s.Append([]byte(scanner.Text())); nil != err {
+			return err
+		}
+		count++
+	}
+	if err = scanner.Err(); nil != err {
+		return err
+	}
+
+	if err = s.Flush(); nil != err {
+		return err
+	}
+	s.logger.Printf("Imported %d results from %s", count, path)
+	return os.Remove(path)
+}
@@ -0,0 +1,215 @@
+package sensu
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// how sealed segments of the stat store are compressed. the segment we are
+// writing to is always plain, so a torn record can still be cut off its end
+type statStoreCodec struct {
+	ext        string // added to the name of a compressed segment
+	compress   func(io.Writer) (io.WriteCloser, error)
+	decompress func(io.Reader) (io.ReadCloser, error)
+}
+
+var statStoreCodecs = map[string]statStoreCodec{
+	"gzip": {
+		ext: ".gz",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+}
+
+// every compression a segment may have been written with, by its extension,
+// whether or not this build can read it
+var statStoreCompressions = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+}
+
+// the compression of a segment this build cannot read, so that we don't
+// quietly skip over the results in it
+func unknownCompression(name string) (string, bool) {
+	for ext, compression := range statStoreCompressions {
+		if !strings.HasSuffix(name, ".wal"+ext) {
+			continue
+		}
+		if _, ok := statStoreCodecs[compression]; !ok {
+			return compression, true
+		}
+	}
+	return "", false
+}
+
+// a segment we can replay from, plain or compressed
+type segmentReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type memorySegment struct {
+	*bytes.Reader
+}
+
+func (memorySegment) Close() error {
+	return nil
+}
+
+// the codec for the configured compression, nil for none
+func (s *statStore) codec() *statStoreCodec {
+	name := s.config.Compression
+	if "" == name || "none" == name {
+		return nil
+	}
+	if codec, ok := statStoreCodecs[name]; ok {
+		return &codec
+	}
+	return nil
+}
+
+// works out the sequence number from a segment file name, plain or compressed
+func parseSegmentName(name string) (uint64, string, bool) {
+	ext := ""
+	for _, codec := range statStoreCodecs {
+		if strings.HasSuffix(name, ".wal"+codec.ext) {
+			ext = codec.ext
+			break
+		}
+	}
+	if !strings.HasSuffix(name, ".wal"+ext) {
+		return 0, "", false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".wal"+ext), 10, 64)
+	if nil != err {
+		return 0, "", false
+	}
+	return seq, ext, true
+}
+
+// the file holding a segment, whichever way it was written
+func (s *statStore) segmentFile(seq uint64) (string, *statStoreCodec) {
+	plain := s.segmentPath(seq)
+	for _, codec := range statStoreCodecs {
+		if _, err := os.Stat(plain + codec.ext); nil == err {
+			c := codec
+			return plain + codec.ext, &c
+		}
+	}
+	return plain, nil
+}
+
+// opens a segment for replay. compressed segments are unpacked into memory,
+// they are no bigger than segment_size once they are
+func (s *statStore) openSegment(seq uint64) (segmentReader, error) {
+	path, codec := s.segmentFile(seq)
+	f, err := os.Open(path)
+	if nil != err || nil == codec {
+		return f, err
+	}
+	defer f.Close()
+
+	r, err := codec.decompress(f)
+	if nil != err {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	defer r.Close()
+
+	// a segment cut short by a crash still gives us the records before the damage
+	data, err := ioutil.ReadAll(r)
+	if nil != err && 0 == len(data) {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return memorySegment{bytes.NewReader(data)}, nil
+}
+
+// compresses a sealed segment. the compressed copy is synced and renamed into
+// place before the plain one is removed, so a crash leaves one or the other.
+// only the rename is done holding the lock, a segment that was replayed or
+// dropped while we were compressing it is left gone
+func (s *statStore) compressSegment(seq uint64, codec *statStoreCodec) error {
+	plain := s.segmentPath(seq)
+	in, err := os.Open(plain)
+	if nil != err {
+		return err
+	}
+	defer in.Close()
+
+	tmp := plain + codec.ext + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if nil != err {
+		return err
+	}
+
+	w, err := codec.compress(out)
+	if nil == err {
+		_, err = io.Copy(w, in)
+		if closeErr := w.Close(); nil == err {
+			err = closeErr
+		}
+	}
+	if nil == err && statStoreFsyncNever != s.config.Fsync {
+		err = out.Sync()
+	}
+	out.Close()
+	if nil != err {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err = os.Stat(plain); nil != err {
+		os.Remove(tmp)
+		return nil
+	}
+	if err = os.Rename(tmp, plain+codec.ext); nil != err {
+		os.Remove(tmp)
+		return err
+	}
+	s.sealedSegment(seq, plain+codec.ext)
+	return os.Remove(plain)
+}
+
+// counts a segment at its compressed size. it keeps the age of the plain one,
+// here and after a restart, so max_age still goes from when it was written
+func (s *statStore) sealedSegment(seq uint64, path string) {
+	for i := range s.sealed {
+		if seq != s.sealed[i].seq {
+			continue
+		}
+		os.Chtimes(path, s.sealed[i].modTime, s.sealed[i].modTime)
+		if info, err := os.Stat(path); nil == err {
+			s.sealedSize += info.Size() - s.sealed[i].size
+			s.sealed[i].size = info.Size()
+		}
+		return
+	}
+}
+
+// removes a segment, whichever way it was written
+func (s *statStore) removeSegment(seq uint64) {
+	plain := s.segmentPath(seq)
+	os.Remove(plain)
+	for _, codec := range statStoreCodecs {
+		os.Remove(plain + codec.ext)
+	}
+
+	for i, segment := range s.sealed {
+		if seq == segment.seq {
+			s.sealedSize -= segment.size
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package sensu
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStatStore(t *testing.T, dir string, config StatStoreConfig) *statStore {
+	s, err := openStatStore(dir, config, log.New(ioutil.Discard, "", 0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testStatStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sensu-stat-store")
+	if nil != err {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// replays everything in the store, committing as it goes
+func drainStatStore(t *testing.T, s *statStore) []string {
+	var replayed []string
+	for {
+		payload, next, err := s.Next()
+		if io.EOF == err {
+			return replayed
+		}
+		if nil != err {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, string(payload))
+		s.Commit(next)
+	}
+}
+
+func Test_StatStoreReplay(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestStatStore(t, dir, StatStoreConfig{})
+	for i := 0; i < 3; i++ {
+		s.Append([]byte(fmt.Sprintf("result %d", i)))
+	}
+
+	// the first result is published, the second is read but never makes it
+	payload, next, _ := s.Next()
+	if "result 0" != string(payload) {
+		t.Fatalf("expected result 0, got %q", payload)
+	}
+	s.Commit(next)
+	s.Next()
+	s.Close()
+
+	s = newTestStatStore(t, dir, StatStoreConfig{})
+	defer s.Close()
+	replayed := drainStatStore(t, s)
+	if 2 != len(replayed) || "result 1" != replayed[0] || "result 2" != replayed[1] {
+		t.Errorf("expected the unpublished results after a restart, got %v", replayed)
+	}
+
+	s.Append([]byte("result 3"))
+	if replayed = drainStatStore(t, s); 1 != len(replayed) || "result 3" != replayed[0] {
+		t.Errorf("expected only the new result, got %v", replayed)
+	}
+}
+
+func Test_StatStoreTornRecord(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestStatStore(t, dir, StatStoreConfig{})
+	s.Append([]byte("complete"))
+	s.Append([]byte("torn in half"))
+	s.Close()
+
+	// a crash part way through writing the last record
+	path := s.segmentPath(s.activeSeq)
+	info, _ := os.Stat(path)
+	os.Truncate(path, info.Size()-4)
+
+	s = newTestStatStore(t, dir, StatStoreConfig{})
+	defer s.Close()
+	s.Append([]byte("after the crash"))
+
+	replayed := drainStatStore(t, s)
+	if 2 != len(replayed) || "complete" != replayed[0] || "after the crash" != replayed[1] {
+		t.Errorf("expected the torn record to be dropped, got %v", replayed)
+	}
+}
+
+func Test_StatStoreRetention(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	// room for 4 segments of 2 records each
+	s := newTestStatStore(t, dir, StatStoreConfig{MaxSize: 4 * 2 * 18, SegmentSize: 2 * 18})
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		s.Append([]byte(fmt.Sprintf("result %02d", i))) // 10 bytes, 18 with the header
+	}
+
+	if size := s.Size(); size > s.config.MaxSize {
+		t.Errorf("expected the store to stay under %d bytes, it is %d", s.config.MaxSize, size)
+	}
+
+	replayed := drainStatStore(t, s)
+	if 0 == len(replayed) || "result 19" != replayed[len(replayed)-1] {
+		t.Fatalf("expected the newest results to be kept, got %v", replayed)
+	}
+	if "result 00" == replayed[0] {
+		t.Errorf("expected the oldest results to be dropped, got %v", replayed)
+	}
+
+	segments, _ := s.segments()
+	if 1 != len(segments) {
+		t.Errorf("expected replayed segments to be removed, %d left", len(segments))
+	}
+}
+
+func Test_StatStoreImportLegacy(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	legacy := filepath.Join(dir, "stats.json")
+	ioutil.WriteFile(legacy, []byte("{\"client\":\"a\"}\n\n{\"client\":\"b\"}\n"), 0600)
+
+	s := newTestStatStore(t, legacy+".wal", StatStoreConfig{})
+	defer s.Close()
+	if err := s.importLegacy(legacy); nil != err {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Error("expected the old stat store to be removed")
+	}
+	replayed := drainStatStore(t, s)
+	if 2 != len(replayed) || `{"client":"b"}` != replayed[1] {
+		t.Errorf("expected the old results to be replayed, got %v", replayed)
+	}
+}
+
+func Test_StatStoreCompression(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	line := `{"client":"stb.test","check":{"name":"cpu_metrics","output":"stb.test.cpu.user 12 1430000000"}}`
+
+	// written before compression was turned on
+	s := newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096})
+	for i := 0; i < 100; i++ {
+		s.Append([]byte(line))
+	}
+	s.Close()
+
+	s = newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, Compression: "gzip"})
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Append([]byte(line))
+	}
+	s.waitForSeals()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.wal.gz"))
+	if 0 == len(files) {
+		t.Fatal("expected full segments to be compressed")
+	}
+	plain, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if 1 != len(plain) {
+		t.Errorf("expected only the segment being written to to be plain, got %v", plain)
+	}
+	if size := s.Size(); size > int64(200*len(line))/4 {
+		t.Errorf("expected the size to count compressed bytes, got %d", size)
+	}
+
+	replayed := drainStatStore(t, s)
+	if 200 != len(replayed) {
+		t.Fatalf("expected 200 results, got %d", len(replayed))
+	}
+	for _, r := range replayed {
+		if line != r {
+			t.Fatalf("unexpected result: %q", r)
+		}
+	}
+}
+
+func Test_StatStoreUnreadableSegments(t *testing.T) {
+	if _, ok := statStoreCodecs["zstd"]; ok {
+		t.Skip("built with zstd")
+	}
+
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "0000000001.wal.zst"), []byte("compressed"), 0600)
+
+	if _, err := openStatStore(dir, StatStoreConfig{}, log.New(ioutil.Discard, "", 0)); nil == err {
+		t.Error("expected a store with segments we cannot read to refuse to open")
+	}
+}
+
+func Test_StatStoreSealsInBackground(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, Compression: "gzip"})
+	line := `{"client":"stb.test","check":{"name":"cpu_metrics","output":"stb.test.cpu.user 12 1430000000"}}`
+
+	// replay while segments are being sealed, committing as we go
+	done := make(chan []string)
+	go func() {
+		var replayed []string
+		for len(replayed) < 500 {
+			payload, next, err := s.Next()
+			if nil != err {
+				time.Sleep(time.Millisecond) // caught up, wait for more
+				continue
+			}
+			s.Commit(next)
+			replayed = append(replayed, string(payload))
+		}
+		done <- replayed
+	}()
+	for i := 0; i < 500; i++ {
+		s.Append([]byte(line))
+	}
+
+	if replayed := <-done; 500 != len(replayed) {
+		t.Errorf("expected 500 results, got %d", len(replayed))
+	}
+	s.Close()
+
+	leftover, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if 0 != len(leftover) {
+		t.Errorf("expected no half compressed segments left behind, got %v", leftover)
+	}
+}
+
+func Test_StatStoreClose(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	s := newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, Compression: "gzip"})
+	for i := 0; i < 200; i++ {
+		s.Append([]byte(fmt.Sprintf("result %d with some padding to fill up the segments", i)))
+	}
+	s.Close()
+
+	if err := s.Append([]byte("too late")); errStatStoreClosed != err {
+		t.Errorf("expected appending to a closed store to fail, got %v", err)
+	}
+	// every full segment has been sealed, leaving only the one we were writing to
+	if plain, _ := filepath.Glob(filepath.Join(dir, "*.wal")); 1 != len(plain) {
+		t.Errorf("expected the seals to finish before Close returns, got %v", plain)
+	}
+
+	s = newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, Compression: "gzip"})
+	defer s.Close()
+	if replayed := drainStatStore(t, s); 200 != len(replayed) {
+		t.Errorf("expected every result in the reopened store, got %d", len(replayed))
+	}
+}
+
+// the size we keep count of is the size on disk
+func diskSize(dir string) int64 {
+	var size int64
+	files, _ := filepath.Glob(filepath.Join(dir, "*.wal*"))
+	for _, f := range files {
+		if info, err := os.Stat(f); nil == err {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func Test_StatStoreTracksSize(t *testing.T) {
+	dir := testStatStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	line := `{"client":"stb.test","check":{"name":"cpu_metrics","output":"stb.test.cpu.user 12 1430000000"}}`
+	s := newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, MaxSize: 6 * 4096, Compression: "gzip"})
+	for i := 0; i < 500; i++ {
+		s.Append([]byte(line))
+	}
+	s.waitForSeals()
+	if size := s.Size(); diskSize(dir) != size {
+		t.Errorf("expected a size of %d after sealing, got %d", diskSize(dir), size)
+	}
+
+	drainStatStore(t, s)
+	if size := s.Size(); diskSize(dir) != size {
+		t.Errorf("expected a size of %d after replaying, got %d", diskSize(dir), size)
+	}
+	s.Close()
+
+	// written an hour ago and sealed now, the segments still count as an hour old
+	s = newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096})
+	for i := 0; i < 200; i++ {
+		s.Append([]byte(line))
+	}
+	s.Close()
+	old := time.Now().Add(-time.Hour)
+	plain, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	for _, f := range plain {
+		os.Chtimes(f, old, old)
+	}
+	s = newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, Compression: "gzip"})
+	s.Close()
+	if sealed, _ := filepath.Glob(filepath.Join(dir, "*.wal.gz")); 0 == len(sealed) {
+		t.Fatal("expected the full segments to be compressed")
+	}
+
+	s = newTestStatStore(t, dir, StatStoreConfig{SegmentSize: 4096, MaxAge: 60, Compression: "gzip"})
+	defer s.Close()
+	if sealed, _ := filepath.Glob(filepath.Join(dir, "*.wal.gz")); 0 != len(sealed) {
+		t.Errorf("expected the old segments to be dropped, got %v", sealed)
+	}
+	if size := s.Size(); diskSize(dir) != size {
+		t.Errorf("expected a size of %d after dropping old segments, got %d", diskSize(dir), size)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build zstd
+// +build zstd
+
+package sensu
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"io"
+)
+
+// zstd needs github.com/klauspost/compress, so it is only built in with -tags zstd
+func init() {
+	statStoreCodecs["zstd"] = statStoreCodec{
+		ext: ".zst",
+		compress: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if nil != err {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package sensu
+
+import (
+	"fmt"
+	"plugins"
+	"strings"
+	"time"
+)
+
+// the layouts we accept for the begin and end of a subdue window
+var subdueTimeLayouts = []string{"15:04", "15:04:05", "3:04PM", "3:04 PM", "3:04pm", "3:04 pm", "3PM", "3 PM", "3pm", "3 pm"}
+
+var subdueDays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// whether or not a check should be left alone at time t. t should already be
+// in the time zone the window is written in
+func subdued(subdue *plugins.Subdue, t time.Time) (bool, error) {
+	if nil == subdue {
+		return false, nil
+	}
+
+	in, err := inSubdueWindow(*subdue, t)
+	if nil != err || !in {
+		return false, err
+	}
+
+	for _, exception := range subdue.Exceptions {
+		in, err = inSubdueWindow(exception, t)
+		if nil != err {
+			return false, err
+		}
+		if in {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// a window that spans midnight belongs to the day it began on, so friday
+// 22:00-06:00 also covers the early hours of saturday
+func inSubdueWindow(window plugins.Subdue, t time.Time) (bool, error) {
+	begin, err := subdueTimeOfDay(window.Begin, 0)
+	if nil != err {
+		return false, err
+	}
+	end, err := subdueTimeOfDay(window.End, 24*time.Hour)
+	if nil != err {
+		return false, err
+	}
+
+	now := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()))
+
+	if begin <= end {
+		if now < begin || now >= end {
+			return false, nil
+		}
+		return subdueDay(window.Days, t.Weekday())
+	}
+
+	if now >= begin {
+		return subdueDay(window.Days, t.Weekday())
+	}
+	if now < end {
+		return subdueDay(window.Days, t.AddDate(0, 0, -1).Weekday())
+	}
+	return false, nil
+}
+
+func subdueTimeOfDay(value string, defaultValue time.Duration) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if "" == value {
+		return defaultValue, nil
+	}
+	for _, layout := range subdueTimeLayouts {
+		if parsed, err := time.Parse(layout, value); nil == err {
+			return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute + time.Duration(parsed.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid subdue time of day: %q", value)
+}
+
+func subdueDay(days []string, day time.Weekday) (bool, error) {
+	if 0 == len(days) {
+		return true, nil
+	}
+	for _, name := range days {
+		weekday, ok := subdueDays[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return false, fmt.Errorf("Invalid subdue day: %q", name)
+		}
+		if weekday == day {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,60 @@
+package sensu
+
+import (
+	"plugins"
+	"testing"
+	"time"
+)
+
+func Test_Subdued(t *testing.T) {
+	// 2015-06-12 is a friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2015, time.June, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	nightly := &plugins.Subdue{
+		Days:  []string{"friday"},
+		Begin: "10:00 PM",
+		End:   "06:00",
+		Exceptions: []plugins.Subdue{
+			{Begin: "01:00", End: "01:30"},
+		},
+	}
+
+	for i, tuple := range []struct {
+		subdue   *plugins.Subdue
+		at       time.Time
+		expected bool
+	}{
+		{nil, at(12, 23, 0), false},
+		{nightly, at(12, 21, 59), false},
+		{nightly, at(12, 22, 0), true},
+		{nightly, at(13, 5, 59), true}, // saturday morning is still part of friday night
+		{nightly, at(13, 6, 0), false},
+		{nightly, at(13, 1, 15), false}, // the exception lets us run
+		{nightly, at(11, 23, 0), false}, // thursday
+		{nightly, at(12, 5, 0), false},  // friday morning belongs to thursday night
+		{&plugins.Subdue{Begin: "9am", End: "5pm"}, at(10, 12, 0), true},
+		{&plugins.Subdue{Begin: "9am", End: "5pm"}, at(10, 17, 0), false},
+		{&plugins.Subdue{Days: []string{"sat", "sun"}}, at(13, 12, 0), true},
+		{&plugins.Subdue{Days: []string{"sat", "sun"}}, at(12, 12, 0), false},
+	} {
+		isSubdued, err := subdued(tuple.subdue, tuple.at)
+		if nil != err {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if isSubdued != tuple.expected {
+			t.Errorf("%d. at %s expected subdued to be %t", i, tuple.at.Format(time.RFC1123), tuple.expected)
+		}
+	}
+}
+
+func Test_SubduedInvalid(t *testing.T) {
+	if _, err := subdued(&plugins.Subdue{Begin: "tea time"}, time.Now()); nil == err {
+		t.Error("expected an invalid begin time to fail")
+	}
+	if _, err := subdued(&plugins.Subdue{Days: []string{"caturday"}}, time.Now()); nil == err {
+		t.Error("expected an invalid day to fail")
+	}
+}
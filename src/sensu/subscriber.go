@@ -4,42 +4,83 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/streadway/amqp"
+	"hash/crc32"
 	"io"
 	"log"
 	"plugins"
+	"strings"
+	"sync"
 	"time"
 )
 
+// what we do with a delivery once we are done with it
+type deliveryOutcome int
+
+const (
+	deliveryDone   deliveryOutcome = iota // handled, or of no use to anyone any more. ack it
+	deliveryRetry                         // a transient failure. requeue it and try again
+	deliveryPoison                        // will never succeed. dead-letter it
+)
+
+const subscriberMaxRetries = 3
+const subscriberRetryDelay = time.Second
+
 type Subscriber struct {
-	deliveries <-chan amqp.Delivery
-	done       chan error
-	logger     *log.Logger
-	config     *Config
-	q          MessageQueuer
-	started    bool
+	deliveries   <-chan amqp.Delivery
+	done         chan error
+	logger       *log.Logger
+	config       *Config
+	q            MessageQueuer
+	started      bool
+	attempts     map[string]int    // delivery attempts for requests that failed
+	requeues     map[uint64]func() // requeues waiting on their delay, by delivery tag
+	attemptsLock sync.Mutex        // guards attempts and requeues
+	retryDelay   time.Duration     // multiplied by the attempt for the wait before a requeue
+	counters     *clientCounters   // shared with the plugin processor, see CountWith
+	prefixes     *metricPrefixes
 }
 
 func NewSubscriber(w io.Writer) *Subscriber {
 	s := new(Subscriber)
 	s.logger = log.New(w, "Subscriptions: ", log.LstdFlags)
+	s.attempts = make(map[string]int)
+	s.requeues = make(map[uint64]func())
+	s.retryDelay = subscriberRetryDelay
+	s.counters = new(clientCounters)
+	s.prefixes = newMetricPrefixes()
 	return s
 }
 
+// counts what happens to our requests along with what happens to the
+// processor's own checks, so its stats and metrics cover both
+func (s *Subscriber) CountWith(p *PluginProcessor) {
+	s.counters = p.counters
+}
+
 func (s *Subscriber) Init(q MessageQueuer, c *Config) error {
 
 	s.config = c
 	s.q = q
-	config_name := c.Client.Name
-	config_ver := c.Client.Version
 
-	queue_name := fmt.Sprintf("%s-%s-%d", config_name, config_ver, time.Now().Unix())
+	// RabbitMQ starts counting again with a new connection, and whatever we
+	// were counting has gone back to the queue
+	s.attemptsLock.Lock()
+	s.attempts = make(map[string]int)
+	s.requeues = make(map[uint64]func())
+	s.attemptsLock.Unlock()
+
+	queue_name := subscriptionQueueName(c.Client, time.Now())
 	s.logger.Printf("Declaring Queue: %s", queue_name)
-	queue, err := q.QueueDeclare(queue_name)
+	queue, err := q.QueueDeclare(queue_name, subscriptionQueueOptions(c.Client.SubscriptionQueue))
 	if err != nil {
 		return fmt.Errorf("Queue Declare: %s", err)
 	}
 	s.logger.Printf("declared Queue")
 
+	if err = s.declareDeadLetter(q, c.Client.SubscriptionQueue); err != nil {
+		return err
+	}
+
 	var subscriptions []string
 	subscriptions, err = c.Data().GetPath("client", "subscriptions").StringArray()
 	if err != nil {
@@ -60,7 +101,7 @@ func (s *Subscriber) Init(q MessageQueuer, c *Config) error {
 		}
 	}
 
-	s.logger.Printf("Starting Consume on queue: " + queue.Name)
+	s.logger.Printf("Starting Consume on queue: %s", queue.Name)
 	s.deliveries, err = q.Consume(queue.Name, "")
 	if err != nil {
 		return fmt.Errorf("Queue Consume: %s", err)
@@ -70,6 +111,76 @@ func (s *Subscriber) Init(q MessageQueuer, c *Config) error {
 	return nil
 }
 
+// a dead letter exchange with nothing bound to it throws away everything sent
+// to it, so it gets a durable queue of its own for someone to look at
+func (s *Subscriber) declareDeadLetter(q MessageQueuer, queueConfig SubscriptionQueueConfig) error {
+	exchange := queueConfig.DeadLetterExchange
+	if "" == exchange {
+		return nil
+	}
+
+	s.logger.Printf("declaring dead letter Exchange (%q)", exchange)
+	if err := q.ExchangeDeclare(exchange, "fanout"); err != nil {
+		return fmt.Errorf("Exchange Declare: %s", err)
+	}
+
+	name := queueConfig.DeadLetterQueue
+	if "" == name {
+		name = exchange
+	}
+	s.logger.Printf("Declaring dead letter Queue: %s", name)
+	queue, err := q.QueueDeclare(name, QueueOptions{Durable: true})
+	if err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+	if err = q.QueueBind(queue.Name, "", exchange); err != nil {
+		return fmt.Errorf("Queue Bind: %s", err)
+	}
+	return nil
+}
+
+// a stable queue keeps its name between connections so that requests sent
+// while we were away are waiting for us when we come back
+func subscriptionQueueName(clientConfig ClientConfig, now time.Time) string {
+	queueConfig := clientConfig.SubscriptionQueue
+	if "" != queueConfig.Name {
+		return queueConfig.Name
+	}
+	if queueConfig.Stable || queueConfig.Durable {
+		return fmt.Sprintf("%s-%s", clientConfig.Name, clientConfig.Version)
+	}
+	return fmt.Sprintf("%s-%s-%d", clientConfig.Name, clientConfig.Version, now.Unix())
+}
+
+func subscriptionQueueOptions(queueConfig SubscriptionQueueConfig) QueueOptions {
+	stable := queueConfig.Stable || queueConfig.Durable || "" != queueConfig.Name
+	opts := QueueOptions{
+		Durable:    queueConfig.Durable,
+		AutoDelete: !stable,
+		MessageTTL: time.Duration(queueConfig.MessageTTL) * time.Second,
+		MaxLength:  queueConfig.MaxLength,
+
+		DeadLetterExchange: queueConfig.DeadLetterExchange,
+	}
+
+	// a stable queue outlives us, so one left behind by a client that has been
+	// removed can be told not to collect requests forever. auto-delete queues go
+	// with us anyway
+	if stable && queueConfig.Expires > 0 {
+		opts.Expires = time.Duration(queueConfig.Expires) * time.Second
+	}
+	return opts
+}
+
+// requests that sat in the queue for longer than the message ttl are no longer
+// of any use to anyone. RabbitMQ expires most of them, this catches the rest
+func requestExpired(checkConfig *plugins.PluginConfig, ttl int, now time.Time) bool {
+	if ttl <= 0 || checkConfig.Issued <= 0 {
+		return false
+	}
+	return now.Unix()-checkConfig.Issued > int64(ttl)
+}
+
 func (s *Subscriber) Start() {
 	//go s.handle(s.deliveries, s.done)
 	s.started = true
@@ -90,29 +201,55 @@ func (s *Subscriber) Stop(force bool) {
 		s.done <- nil
 	}
 	s.started = false
+	s.requeueWaiting()
 }
 
+// handles a single check request and settles the delivery with RabbitMQ
 func (s *Subscriber) handle(d amqp.Delivery) {
-	clientConfig := s.config.Client
-
 	defer func() {
 		if r := recover(); r != nil {
 			s.logger.Printf("Caught Panic on Close. %+v", r)
+			s.settle(d, deliveryPoison)
 		}
 	}()
 
+	s.settle(d, s.process(d))
+}
+
+// runs the requested check and publishes the result. the returned outcome
+// tells us what to do with the delivery
+func (s *Subscriber) process(d amqp.Delivery) deliveryOutcome {
+	clientConfig := s.config.Client
+
 	if nil == d.Body {
 		s.logger.Println("Delivery had nil body")
-		d.Reject(false) // discard this message
-		return
+		return deliveryPoison
 	}
 
 	checkConfig := new(plugins.PluginConfig)
 	err := json.Unmarshal(d.Body, checkConfig)
 	if nil != err {
 		s.logger.Printf("Unable to decode message, skipping...")
-		d.Reject(false)
-		return
+		return deliveryPoison
+	}
+	var attributes map[string]interface{}
+	if nil == json.Unmarshal(d.Body, &attributes) {
+		checkConfig.Custom = customAttributes(attributes)
+	}
+
+	if requestExpired(checkConfig, clientConfig.SubscriptionQueue.MessageTTL, time.Now()) {
+		s.logger.Printf("Dropping expired request for '%s', issued at %d", checkConfig.Name, checkConfig.Issued)
+		return deliveryDone
+	}
+
+	if s.requestSubdued(checkConfig) {
+		count := s.counters.countSubduedRequest()
+		s.logger.Printf("Subdued: %s (%d requests subdued)", checkConfig.Name, count)
+		return deliveryDone
+	}
+
+	if nil == checkConfig.Args {
+		checkConfig.Args = strings.Split(checkConfig.Command, " ")
 	}
 
 	//s.logger.Printf("Our check consists of: %+v", checkConfig)
@@ -121,30 +258,196 @@ func (s *Subscriber) handle(d amqp.Delivery) {
 	theJob := getCheckHandler(checkConfig.Name, checkConfig.Type)
 
 	result := NewResult(clientConfig, checkConfig.Name)
-	result.SetCommand(checkConfig.Command)
+	result.SetCheckConfig(*checkConfig)
+	result.SetMetricPrefix(s.prefixes.metricPrefix(s.config, *checkConfig, s.logger))
 
 	plugin_result := new(plugins.Result)
 
-	theJob.Init(*checkConfig)
+	if _, err = theJob.Init(*checkConfig); nil != err {
+		s.logger.Printf("Failed to initialise check: %s. %v", checkConfig.Name, err)
+		return deliveryPoison
+	}
 
 	err = theJob.Gather(plugin_result)
-	result.SetWrapOutput(!plugin_result.IsNoWrapOutput())
-	result.SetOutput(plugin_result.Output())
-	result.SetCheckStatus(theJob.GetStatus())
+	status := result.SetGathered(theJob.GetStatus(), *checkConfig, plugin_result)
+	if result.Truncated() {
+		count := s.counters.countTruncated()
+		s.logger.Printf("Truncated the output of %s (%d results truncated)", checkConfig.Name, count)
+	}
 
 	if nil != err {
-		// returned an error - we should stop this job from running
 		s.logger.Printf("Failed to gather stat: %s. %v", checkConfig.Name, err)
-		return
+		return deliveryRetry
+	}
+
+	// requests carry no history, so their hooks run every time their status matches
+	hooks := checkConfig.Hooks
+	if nil == hooks {
+		if localConfig, ok := s.localCheckConfig(checkConfig.Name); ok {
+			hooks = localConfig.Hooks
+		}
+	}
+	if hook, ok := result.runHooks(hooks, status); ok {
+		s.logger.Printf("Ran the %s hook for %s, exit status %d", hook.Name, checkConfig.Name, hook.Status)
 	}
 
 	// and now send it back
 	if result.HasOutput() {
 		if err = s.q.Publish(RESULTS_QUEUE, "", result.GetPayload()); err != nil {
 			s.logger.Printf("Error Publishing Stats: %v. %v", err, result)
+			return deliveryRetry
 		}
 	}
 
-	d.Ack(false)
+	return deliveryDone
+}
+
+// requests honor their own subdue windows, or those of the check of the same
+// name in our config
+func (s *Subscriber) requestSubdued(checkConfig *plugins.PluginConfig) bool {
+	config := *checkConfig
+	if nil == config.Subdue {
+		if localConfig, ok := s.localCheckConfig(config.Name); ok {
+			config.Subdue = localConfig.Subdue
+			if "" == config.Timezone {
+				config.Timezone = localConfig.Timezone
+			}
+		}
+	}
+
+	isSubdued, err := checkSubdued(config, s.config.Client)
+	if nil != err {
+		s.logger.Printf("Ignoring subdue for %s: %s", config.Name, err)
+		return false
+	}
+	return isSubdued
+}
+
+// the check of the same name in our config, if there is one
+func (s *Subscriber) localCheckConfig(name string) (plugins.PluginConfig, bool) {
+	if nil == s.config.Data() {
+		return plugins.PluginConfig{}, false
+	}
+	local, err := s.config.Data().GetPath("checks", name).Map()
+	if nil != err {
+		return plugins.PluginConfig{}, false
+	}
+	return newCheckConfig(local), true
+}
+
+// acks, requeues or dead-letters a delivery. requests that keep failing are
+// dead-lettered once they have been retried max_retries times
+func (s *Subscriber) settle(d amqp.Delivery, outcome deliveryOutcome) {
+	key := deliveryKey(d)
+
+	switch outcome {
+	case deliveryDone:
+		s.forget(key)
+		if err := d.Ack(false); nil != err {
+			s.logger.Printf("Failed to ack delivery: %v", err)
+		}
+
+	case deliveryRetry:
+		attempts := s.attempt(key, d)
+		if attempts > s.maxRetries() {
+			s.logger.Printf("Giving up on delivery after %d attempts", attempts)
+			s.forget(key)
+			s.deadLetter(d)
+			return
+		}
+
+		delay := time.Duration(attempts) * s.retryDelay
+		s.logger.Printf("Requeueing delivery in %s, attempt %d of %d", delay, attempts, s.maxRetries())
+		s.requeueLater(d, delay)
+
+	case deliveryPoison:
+		s.forget(key)
+		s.deadLetter(d)
+	}
+}
+
+// rejecting without a requeue sends the message to the dead letter exchange
+// when one is configured, otherwise RabbitMQ discards it
+func (s *Subscriber) deadLetter(d amqp.Delivery) {
+	if exchange := s.config.Client.SubscriptionQueue.DeadLetterExchange; "" != exchange {
+		s.logger.Printf("Dead-lettering delivery to %q", exchange)
+	} else {
+		s.logger.Printf("Discarding delivery")
+	}
+	if err := d.Reject(false); nil != err {
+		s.logger.Printf("Failed to reject delivery: %v", err)
+	}
+}
+
+// requeues a delivery once the delay is up, without holding up anything else.
+// the delivery stays unacked until then, so RabbitMQ still has it if we go away
+func (s *Subscriber) requeueLater(d amqp.Delivery, delay time.Duration) {
+	s.attemptsLock.Lock()
+	defer s.attemptsLock.Unlock()
+
+	var once sync.Once
+	requeue := func() {
+		once.Do(func() {
+			s.attemptsLock.Lock()
+			delete(s.requeues, d.DeliveryTag)
+			s.attemptsLock.Unlock()
 
+			if err := d.Reject(true); nil != err {
+				s.logger.Printf("Failed to requeue delivery: %v", err)
+			}
+		})
+	}
+	s.requeues[d.DeliveryTag] = requeue
+	time.AfterFunc(delay, requeue)
+}
+
+// requeues every delivery still waiting on its delay, while the channel they
+// came in on is still open
+func (s *Subscriber) requeueWaiting() {
+	s.attemptsLock.Lock()
+	waiting := make([]func(), 0, len(s.requeues))
+	for _, requeue := range s.requeues {
+		waiting = append(waiting, requeue)
+	}
+	s.attemptsLock.Unlock()
+
+	for _, requeue := range waiting {
+		requeue()
+	}
+}
+
+func (s *Subscriber) maxRetries() int {
+	if retries := s.config.Client.SubscriptionQueue.MaxRetries; retries > 0 {
+		return retries
+	}
+	return subscriberMaxRetries
+}
+
+// counts the attempts made at a delivery. quorum queues count for us in a
+// header, otherwise we remember them ourselves by the message id, or the body
+// when there is none, so that redeliveries with new tags are counted together
+func (s *Subscriber) attempt(key string, d amqp.Delivery) int {
+	if count, ok := d.Headers["x-delivery-count"].(int64); ok {
+		return int(count) + 1
+	}
+
+	s.attemptsLock.Lock()
+	defer s.attemptsLock.Unlock()
+	s.attempts[key]++
+	return s.attempts[key]
+}
+
+func (s *Subscriber) forget(key string) {
+	s.attemptsLock.Lock()
+	delete(s.attempts, key)
+	s.attemptsLock.Unlock()
+}
+
+// identifies a delivery across redeliveries. check requests carry the time
+// they were issued, so the body is unique enough when there is no message id
+func deliveryKey(d amqp.Delivery) string {
+	if "" != d.MessageId {
+		return d.MessageId
+	}
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(d.Body))
 }
@@ -0,0 +1,253 @@
+package sensu
+
+import (
+	"github.com/bitly/go-simplejson"
+	"github.com/streadway/amqp"
+	"io/ioutil"
+	"plugins"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_SubscriptionQueueName(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	client := ClientConfig{Name: "test", Version: "0.14.0"}
+
+	if name := subscriptionQueueName(client, now); name != "test-0.14.0-1400000000" {
+		t.Errorf("expected a per connection queue name, got %s", name)
+	}
+
+	client.SubscriptionQueue.Stable = true
+	if name := subscriptionQueueName(client, now); name != "test-0.14.0" {
+		t.Errorf("expected a stable queue name, got %s", name)
+	}
+
+	client.SubscriptionQueue.Name = "custom"
+	if name := subscriptionQueueName(client, now); name != "custom" {
+		t.Errorf("expected the configured queue name, got %s", name)
+	}
+}
+
+func Test_SubscriptionQueueOptions(t *testing.T) {
+	opts := subscriptionQueueOptions(SubscriptionQueueConfig{})
+	if !opts.AutoDelete || opts.Durable {
+		t.Errorf("expected an auto-delete queue by default, got %+v", opts)
+	}
+
+	opts = subscriptionQueueOptions(SubscriptionQueueConfig{Durable: true, MessageTTL: 60, MaxLength: 10})
+	if opts.AutoDelete || !opts.Durable {
+		t.Errorf("expected a durable queue, got %+v", opts)
+	}
+	if opts.MessageTTL != time.Minute || opts.MaxLength != 10 {
+		t.Errorf("expected a ttl of 1m and max length of 10, got %+v", opts)
+	}
+	if 0 != opts.Expires || "" != opts.DeadLetterExchange {
+		t.Errorf("expected an existing queue to be declared as it always was, got %+v", opts)
+	}
+
+	if opts = subscriptionQueueOptions(SubscriptionQueueConfig{Stable: true, Expires: 600}); opts.Expires != 10*time.Minute {
+		t.Errorf("expected the queue to expire after 10m, got %+v", opts)
+	}
+	if opts = subscriptionQueueOptions(SubscriptionQueueConfig{Expires: 600}); 0 != opts.Expires {
+		t.Errorf("expected an auto-delete queue to have no expiry, got %+v", opts)
+	}
+}
+
+func Test_RequestExpired(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	request := &plugins.PluginConfig{Issued: now.Unix() - 120}
+
+	if requestExpired(request, 0, now) {
+		t.Error("requests should never expire without a ttl")
+	}
+	if !requestExpired(request, 60, now) {
+		t.Error("expected a request issued 120 seconds ago to expire with a 60 second ttl")
+	}
+	if requestExpired(request, 300, now) {
+		t.Error("expected a request issued 120 seconds ago to be current with a 300 second ttl")
+	}
+}
+
+// records what happened to our deliveries
+type testAcknowledger struct {
+	lock                      sync.Mutex
+	acked, requeued, rejected int
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.acked++
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return a.Reject(tag, requeue)
+}
+
+func (a *testAcknowledger) counts() (int, int, int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.acked, a.requeued, a.rejected
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if requeue {
+		a.requeued++
+	} else {
+		a.rejected++
+	}
+	return nil
+}
+
+func Test_SettleDelivery(t *testing.T) {
+	s := NewSubscriber(ioutil.Discard)
+	s.config = &Config{Client: ClientConfig{SubscriptionQueue: SubscriptionQueueConfig{MaxRetries: 1}}}
+	s.retryDelay = 10 * time.Millisecond
+
+	ack := new(testAcknowledger)
+	d := amqp.Delivery{Acknowledger: ack, Body: []byte(`{"name":"test","issued":1}`)}
+
+	s.settle(d, deliveryDone)
+	if 1 != ack.acked {
+		t.Errorf("expected the delivery to be acked, got %+v", ack)
+	}
+
+	s.settle(d, deliveryPoison)
+	if 1 != ack.rejected {
+		t.Errorf("expected the delivery to be rejected, got %+v", ack)
+	}
+
+	// the first failure is requeued, the second is more than max_retries
+	s.settle(d, deliveryRetry)
+	if _, requeued, _ := ack.counts(); 0 != requeued {
+		t.Errorf("expected the requeue to wait, got %+v", ack)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, requeued, _ := ack.counts(); 1 != requeued {
+		t.Errorf("expected the delivery to be requeued, got %+v", ack)
+	}
+	s.settle(d, deliveryRetry)
+	if _, requeued, rejected := ack.counts(); 1 != requeued || 2 != rejected {
+		t.Errorf("expected the delivery to be dead-lettered, got %+v", ack)
+	}
+	if 0 != len(s.attempts) {
+		t.Errorf("expected the attempts to be forgotten, got %v", s.attempts)
+	}
+}
+
+// remembers the queues it was asked to declare and bind
+type recordingQueuer struct {
+	noTransport
+	declared map[string]QueueOptions
+	bound    map[string]string // queue to exchange
+}
+
+func (r *recordingQueuer) QueueDeclare(name string, opts QueueOptions) (amqp.Queue, error) {
+	r.declared[name] = opts
+	return amqp.Queue{Name: name}, nil
+}
+
+func (r *recordingQueuer) QueueBind(name, key, source string) error {
+	r.bound[name] = source
+	return nil
+}
+
+func Test_DeadLetterQueue(t *testing.T) {
+	s := NewSubscriber(ioutil.Discard)
+	q := &recordingQueuer{declared: map[string]QueueOptions{}, bound: map[string]string{}}
+
+	if err := s.declareDeadLetter(q, SubscriptionQueueConfig{}); nil != err || 0 != len(q.declared) {
+		t.Errorf("expected nothing declared without a dead letter exchange, got %v %v", q.declared, err)
+	}
+
+	if err := s.declareDeadLetter(q, SubscriptionQueueConfig{DeadLetterExchange: "failed"}); nil != err {
+		t.Fatal(err)
+	}
+	if opts, ok := q.declared["failed"]; !ok || !opts.Durable || opts.AutoDelete {
+		t.Errorf("expected a durable queue named after the exchange, got %v", q.declared)
+	}
+	if "failed" != q.bound["failed"] {
+		t.Errorf("expected the queue to be bound to the exchange, got %v", q.bound)
+	}
+
+	s.declareDeadLetter(q, SubscriptionQueueConfig{DeadLetterExchange: "failed", DeadLetterQueue: "failed-requests"})
+	if "failed" != q.bound["failed-requests"] {
+		t.Errorf("expected the configured queue to be bound, got %v", q.bound)
+	}
+}
+
+func Test_DeliveryAttempts(t *testing.T) {
+	s := NewSubscriber(ioutil.Discard)
+	s.config = &Config{}
+
+	// redeliveries come with new tags but are the same request
+	first := amqp.Delivery{DeliveryTag: 1, MessageId: "request-1"}
+	again := amqp.Delivery{DeliveryTag: 7, MessageId: "request-1"}
+	s.attempt(deliveryKey(first), first)
+	if 2 != s.attempt(deliveryKey(again), again) {
+		t.Errorf("expected redeliveries to be counted together, got %v", s.attempts)
+	}
+
+	// quorum queues count for us
+	counted := amqp.Delivery{MessageId: "request-2", Headers: amqp.Table{"x-delivery-count": int64(2)}}
+	if 3 != s.attempt(deliveryKey(counted), counted) || 1 != len(s.attempts) {
+		t.Errorf("expected the delivery count header to be used, got %v", s.attempts)
+	}
+
+	// a new connection starts again
+	s.Init(new(noTransport), &Config{rawData: simplejson.New()})
+	if 0 != len(s.attempts) {
+		t.Errorf("expected the attempts to be cleared on reconnect, got %v", s.attempts)
+	}
+}
+
+func Test_StopRequeuesWaitingDeliveries(t *testing.T) {
+	s := NewSubscriber(ioutil.Discard)
+	s.config = &Config{}
+	s.retryDelay = time.Hour
+
+	ack := new(testAcknowledger)
+	s.settle(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Body: []byte(`{"name":"a"}`)}, deliveryRetry)
+	s.settle(amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, Body: []byte(`{"name":"b"}`)}, deliveryRetry)
+
+	s.Stop(false)
+	if _, requeued, _ := ack.counts(); 2 != requeued {
+		t.Errorf("expected both deliveries to be requeued on stop, got %+v", ack)
+	}
+	if 0 != len(s.requeues) {
+		t.Errorf("expected nothing left waiting, got %d", len(s.requeues))
+	}
+}
+
+func Test_CountWithProcessor(t *testing.T) {
+	p := NewPluginProcessor(ioutil.Discard, "")
+	exporter := NewPrometheusExporter(ioutil.Discard, PrometheusConfig{})
+	p.SetExporter(exporter)
+
+	s := NewSubscriber(ioutil.Discard)
+	s.CountWith(p)
+	s.counters.countTruncated()
+	p.counters.countTruncated()
+
+	s.counters.countSubduedRequest()
+	p.counters.countSubduedRun()
+
+	stats := p.Stats()
+	if 2 != stats.Truncated {
+		t.Errorf("expected the truncated results of both to be counted together, got %d", stats.Truncated)
+	}
+	if 1 != stats.SubduedRuns || 1 != stats.SubduedRequests {
+		t.Errorf("expected one subdued run and one subdued request, got %+v", stats)
+	}
+	metrics := exporter.checks[clientMetricsCheck]
+	if 3 != len(metrics) || 2 != metrics[0].Value || !metrics[0].Counter {
+		t.Errorf("expected a truncated results counter of 2, got %+v", metrics)
+	}
+	if 1 != metrics[2].Value || "sensu_client.subdued_requests" != metrics[2].Name {
+		t.Errorf("expected a subdued requests counter of 1, got %+v", metrics)
+	}
+}